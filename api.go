@@ -0,0 +1,353 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thecsw/rei"
+)
+
+// customKeyIgnoredHeader is set on creation when the custom key was not used
+// because the URL was already shortened under another key.
+const customKeyIgnoredHeader = "X-Monokuma-Custom-Key-Ignored"
+
+// apiLinkRequest is the body of link creation and update requests.
+type apiLinkRequest struct {
+	// URL is the link to shorten.
+	URL string `json:"url"`
+	// Key is the custom key, empty to generate one.
+	Key string `json:"key,omitempty"`
+	// TTL is how long the link should live, like "72h".
+	TTL string `json:"ttl,omitempty"`
+	// Expires is when the link should expire, in RFC 3339.
+	Expires string `json:"expires,omitempty"`
+	// Alias is whether to create a new key even if the URL is already
+	// shortened, nil for the server's default.
+	Alias *bool `json:"alias,omitempty"`
+}
+
+// apiLink is a short link as the API gives it.
+type apiLink struct {
+	// Key is the key of the short link.
+	Key string `json:"key"`
+	// ShortURL is the short link itself.
+	ShortURL string `json:"short_url"`
+	// URL is where the short link goes.
+	URL string `json:"url"`
+	// CreatedAt is when the short link was created, if known.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// ExpiresAt is when the short link expires, if it does.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// DisabledAt is when the short link was disabled, if it is.
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	// Aliases are the other keys of the same URL.
+	Aliases []string `json:"aliases,omitempty"`
+	// CreatedBy is the name of the API token that created the short link, if
+	// known.
+	CreatedBy string `json:"created_by,omitempty"`
+	// Deduplicated is true if the URL was already shortened, only on creation.
+	Deduplicated *bool `json:"deduplicated,omitempty"`
+	// CustomKeyIgnored is true if the custom key was not used because the URL
+	// was already shortened under another key, only on creation.
+	CustomKeyIgnored bool `json:"custom_key_ignored,omitempty"`
+}
+
+// apiHistoryEntry is a URL that a short link pointed to before.
+type apiHistoryEntry struct {
+	// ReplacedAt is when the URL was replaced.
+	ReplacedAt time.Time `json:"replaced_at"`
+	// URL is the replaced URL.
+	URL string `json:"url"`
+}
+
+// apiLinkStats are the clicks of a short link as the API gives them.
+type apiLinkStats struct {
+	// Key is the key of the short link.
+	Key string `json:"key"`
+	// Clicks is the total number of clicks.
+	Clicks int64 `json:"clicks"`
+	// Days are the clicks per day (UTC), like "2025-01-01".
+	Days map[string]int64 `json:"days"`
+	// Referrers are the clicks per referrer host, "direct" for no referrer.
+	Referrers map[string]int64 `json:"referrers"`
+	// Agents are the clicks per user-agent family, like "Firefox".
+	Agents map[string]int64 `json:"agents"`
+	// Traffic is the class of traffic counted, like "human".
+	Traffic string `json:"traffic"`
+	// VisitorDays is the approximate sum of the unique visitors of every day
+	// (someone visiting on two days is counted twice), only for human traffic.
+	VisitorDays *int64 `json:"visitor_days,omitempty"`
+	// DailyVisitors are the approximate unique visitors per day (UTC), only
+	// for human traffic.
+	DailyVisitors map[string]int64 `json:"daily_visitors,omitempty"`
+}
+
+// apiError is an error as the API gives it.
+type apiError struct {
+	// Status is the name of the MonokumaStatusCode.
+	Status string `json:"status"`
+	// Error is the error message.
+	Error string `json:"error"`
+}
+
+// apiLinks sets up the JSON API routes for the links, see /api/v1/links.
+func apiLinks(r chi.Router) {
+	r.With(requireScope(scopeCreate), limitCreations).Post("/", apiCreateLink)
+	r.With(requireScope(scopeExport)).Get("/", apiExportLinks)
+	r.With(requireScope(scopeExport)).Get("/{key}", apiGetLink)
+	r.With(requireScope(scopeUpdate)).Put("/{key}", apiUpdateLink)
+	r.With(requireScope(scopeUpdate)).Patch("/{key}", apiUpdateLink)
+	r.With(requireScope(scopeDelete)).Delete("/{key}", apiDeleteLink)
+	r.With(requireScope(scopeDelete)).Post("/{key}/disable", apiDisableLink)
+	r.With(requireScope(scopeDelete)).Post("/{key}/enable", apiEnableLink)
+	r.With(requireScope(scopeUpdate)).Post("/{key}/revert", apiRevertLink)
+	r.With(requireScope(scopeExport)).Get("/{key}/history", apiLinkHistory)
+	r.With(requireScope(scopeStats)).Get("/{key}/stats", apiGetLinkStats)
+}
+
+// wantsJSON returns true if the client asked for JSON.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeJSON writes the value as JSON with the given HTTP status.
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError writes the error, as JSON if the client asked for it or as plain
+// text otherwise.
+func writeError(w http.ResponseWriter, r *http.Request, code MonokumaStatusCode, err error) {
+	// let the client know when the store might be back.
+	if code == StoreUnavailable {
+		w.Header().Set("Retry-After", retryAfter())
+	}
+	if wantsJSON(r) || strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, monokumaHttpCode(code), apiError{Status: code.String(), Error: err.Error()})
+		return
+	}
+	w.WriteHeader(monokumaHttpCode(code))
+	w.Write([]byte(err.Error()))
+}
+
+// unixTime returns the unix time as a time, nil if it's zero.
+func unixTime(unix int64) *time.Time {
+	if unix == 0 {
+		return nil
+	}
+	t := time.Unix(unix, 0).UTC()
+	return &t
+}
+
+// toApiLink converts what we know about the short link for the API.
+func toApiLink(info linkInfo) apiLink {
+	return apiLink{
+		Key:        info.Key,
+		ShortURL:   shortUrl(info.Key),
+		URL:        info.Link,
+		CreatedAt:  unixTime(info.Meta.Created),
+		ExpiresAt:  unixTime(info.Meta.Expires),
+		DisabledAt: unixTime(info.Meta.Disabled),
+		Aliases:    info.Aliases,
+		CreatedBy:  info.Meta.CreatedBy,
+	}
+}
+
+// readApiLinkRequest reads the link request from the body.
+func readApiLinkRequest(w http.ResponseWriter, r *http.Request) (apiLinkRequest, bool) {
+	req := apiLinkRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, BadLink, fmt.Errorf("decoding the body: %v", err))
+		return req, false
+	}
+	return req, true
+}
+
+// apiCreateLink creates a new link.
+func apiCreateLink(w http.ResponseWriter, r *http.Request) {
+	req, ok := readApiLinkRequest(w, r)
+	if !ok {
+		return
+	}
+	opts := createOptions{customKey: req.Key, ttl: req.TTL, expires: req.Expires, createdBy: tokenName(r)}
+	if req.Alias != nil {
+		opts.alias = strconv.FormatBool(*req.Alias)
+	}
+	info, code, err := operationCreateLink(strings.NewReader(req.URL), opts)
+	if err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+	if !info.Deduped {
+		markCreated(r)
+	}
+	if info.CustomKeyIgnored {
+		w.Header().Set(customKeyIgnoredHeader, "true")
+	}
+	writeJSON(w, createdStatus(info), createdApiLink(info))
+}
+
+// createdStatus is 201 Created for new links and 200 OK for deduplicated ones.
+func createdStatus(info linkInfo) int {
+	if info.Deduped {
+		return http.StatusOK
+	}
+	return http.StatusCreated
+}
+
+// createdApiLink is the API link with whether it was deduplicated.
+func createdApiLink(info linkInfo) apiLink {
+	link := toApiLink(info)
+	link.Deduplicated = &info.Deduped
+	link.CustomKeyIgnored = info.CustomKeyIgnored
+	return link
+}
+
+// apiExportLinks lists all the links.
+func apiExportLinks(w http.ResponseWriter, r *http.Request) {
+	links, code, err := operationExportLinks()
+	if err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, exportedApiLinks(links))
+}
+
+// exportedApiLinks converts the exported key,link lines for the API, with
+// the aliases of each link.
+func exportedApiLinks(links []string) []apiLink {
+	keys := make(map[string][]string, len(links))
+	for _, line := range links {
+		key, linkb64, _ := strings.Cut(line, ",")
+		keys[linkb64] = append(keys[linkb64], key)
+	}
+	out := make([]apiLink, 0, len(links))
+	for _, line := range links {
+		key, linkb64, _ := strings.Cut(line, ",")
+		out = append(out, apiLink{
+			Key:      key,
+			ShortURL: shortUrl(key),
+			URL:      string(rei.AtobMust(linkb64)),
+			Aliases:  slices.DeleteFunc(slices.Clone(keys[linkb64]), func(k string) bool { return k == key }),
+		})
+	}
+	return out
+}
+
+// apiGetLink gives everything about a link.
+func apiGetLink(w http.ResponseWriter, r *http.Request) {
+	writeApiLinkInfo(w, r, chi.URLParam(r, "key"))
+}
+
+// writeApiLinkInfo writes everything about the key.
+func writeApiLinkInfo(w http.ResponseWriter, r *http.Request, key string) {
+	info, code, err := operationGetLinkInfo(key)
+	if err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toApiLink(info))
+}
+
+// apiUpdateLink points a key to a new link.
+func apiUpdateLink(w http.ResponseWriter, r *http.Request) {
+	req, ok := readApiLinkRequest(w, r)
+	if !ok {
+		return
+	}
+	key := chi.URLParam(r, "key")
+	if code, err := operationUpdateLink(key, strings.NewReader(req.URL)); err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+	writeApiLinkInfo(w, r, key)
+}
+
+// apiDeleteLink deletes a link.
+func apiDeleteLink(w http.ResponseWriter, r *http.Request) {
+	if code, err := operationDeleteLink(chi.URLParam(r, "key")); err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiDisableLink disables a link.
+func apiDisableLink(w http.ResponseWriter, r *http.Request) {
+	apiSetLinkDisabled(w, r, true)
+}
+
+// apiEnableLink enables a link.
+func apiEnableLink(w http.ResponseWriter, r *http.Request) {
+	apiSetLinkDisabled(w, r, false)
+}
+
+// apiSetLinkDisabled disables or enables a link.
+func apiSetLinkDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	key := chi.URLParam(r, "key")
+	if code, err := operationSetLinkDisabled(key, disabled); err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+	writeApiLinkInfo(w, r, key)
+}
+
+// apiRevertLink points a key back to the link it had before the last update.
+func apiRevertLink(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	if code, err := operationRevertLink(key); err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+	writeApiLinkInfo(w, r, key)
+}
+
+// apiLinkHistory gives the links a key pointed to before.
+func apiLinkHistory(w http.ResponseWriter, r *http.Request) {
+	history, code, err := operationGetLinkHistory(chi.URLParam(r, "key"))
+	if err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+	out := make([]apiHistoryEntry, 0, len(history))
+	for _, entry := range history {
+		out = append(out, apiHistoryEntry{
+			ReplacedAt: time.Unix(entry.Replaced, 0).UTC(),
+			URL:        string(rei.AtobMust(entry.Link)),
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// apiGetLinkStats gives the clicks of a link, of human traffic unless asked
+// otherwise with the traffic query parameter.
+func apiGetLinkStats(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	traffic := r.URL.Query().Get("traffic")
+	stats, code, err := operationGetLinkStats(key, traffic)
+	if err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+	out := apiLinkStats{
+		Key:       key,
+		Clicks:    stats.Clicks,
+		Days:      stats.Days,
+		Referrers: stats.Referrers,
+		Agents:    stats.Agents,
+		Traffic:   cmp.Or(traffic, trafficHuman),
+	}
+	if stats.DailyVisitors != nil {
+		out.VisitorDays, out.DailyVisitors = &stats.VisitorDays, stats.DailyVisitors
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	// blocklistPath is the path to the file with the hosts whose links can't
+	// be shortened, empty for none.
+	blocklistPath *string
+
+	// blockedHosts are the hosts from blocklistPath, see isBlocked.
+	blockedHosts map[string]bool
+)
+
+// loadBlocklist loads the hosts from the file at path, or none if path is
+// empty. Each line is a host, like "example.com", empty lines and lines
+// starting with # are skipped.
+func loadBlocklist(path string) (map[string]bool, error) {
+	hosts := map[string]bool{}
+	if len(path) < 1 {
+		return hosts, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening blocklist: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		host := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if len(host) < 1 || strings.HasPrefix(host, "#") {
+			continue
+		}
+		hosts[strings.TrimSuffix(host, ".")] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading blocklist from %s: %w", path, err)
+	}
+	return hosts, nil
+}
+
+// isBlocked returns the blocked host of the link, if its host or any domain
+// above it (like example.com for www.example.com) is blocked.
+func isBlocked(link string) (string, bool) {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return "", false
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	blocked := setting(&blockedHosts)
+	for len(host) > 0 {
+		if blocked[host] {
+			return host, true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return "", false
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/thecsw/rei"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// storePath is the path to the file used by the bolt store.
+	storePath *string
+)
+
+// boltStore is a LinkStore that keeps everything in a single bbolt file, each
+// table being a bucket. Good for small deployments that don't want to run a
+// redis server.
+type boltStore struct {
+	// db is the bolt database.
+	db *bolt.DB
+}
+
+// NewBoltStore opens (or creates) the bolt store at the given path.
+func NewBoltStore(path string) *boltStore {
+	// bolt locks the file, don't hang forever if another process has it.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		log.Fatalf("opening bolt store at %s: %v", path, err)
+	}
+	// make sure the tables exist, so readers never have to create them.
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, table := range storeTables {
+			if _, err := tx.CreateBucketIfNotExists([]byte(table)); err != nil {
+				return fmt.Errorf("creating table %s: %w", table, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("initializing bolt store at %s: %v", path, err)
+	}
+	return &boltStore{db: db}
+}
+
+// bucketGet returns the value of the key in the table, nil if not found.
+func bucketGet(tx *bolt.Tx, table, key string) []byte {
+	bucket := tx.Bucket([]byte(table))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Get([]byte(key))
+}
+
+// bucketExpired returns true if the key has expired by now.
+func bucketExpired(tx *bolt.Tx, key string, now int64) bool {
+	meta, err := decodeLinkMeta(string(bucketGet(tx, linkMetaTable, key)))
+	return err == nil && meta.expired(now)
+}
+
+// bucketFollowable returns true if the key can be followed by now, see
+// linkMeta.followable.
+func bucketFollowable(tx *bolt.Tx, key string, now int64) bool {
+	meta, err := decodeLinkMeta(string(bucketGet(tx, linkMetaTable, key)))
+	return err != nil || meta.followable(now)
+}
+
+// writeLink writes a new link with its metadata to the store. If customKey
+// is provided, it will be used as the key. Otherwise, a new key will be
+// generated. If alias is set, the link gets the new key even if it's already
+// shortened.
+func (b *boltStore) writeLink(linkb64, customKey string, meta linkMeta, alias bool) (key string, deduped bool, err error) {
+	// bolt only allows one writer at a time, so the check and the write
+	// happen atomically.
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		hash := rei.Sha256([]byte(linkb64))
+		now := time.Now().Unix()
+		claim := func(key string) (string, bool, error) {
+			if !alias {
+				// disabled keys would answer 410, give a new one instead.
+				for _, owner := range splitKeys(string(bucketGet(tx, linkExistsTable, hash))) {
+					if bucketFollowable(tx, owner, now) {
+						return owner, true, nil
+					}
+				}
+			}
+			if bucketGet(tx, keyToLinkTable, key) != nil {
+				if !bucketExpired(tx, key, now) {
+					return "", false, errKeyExists
+				}
+				// sweep the expired key ourselves.
+				if _, err := bucketRemove(tx, key); err != nil {
+					return "", false, fmt.Errorf("sweeping expired key ('%s'): %w", key, err)
+				}
+			}
+			if err := tx.Bucket([]byte(keyToLinkTable)).Put([]byte(key), []byte(linkb64)); err != nil {
+				return "", false, fmt.Errorf("saving key and link (key='%s', link='%s'): %w", key, linkb64, err)
+			}
+			keys := addKey(string(bucketGet(tx, linkExistsTable, hash)), key)
+			if err := tx.Bucket([]byte(linkExistsTable)).Put([]byte(hash), []byte(keys)); err != nil {
+				return "", false, fmt.Errorf("saving hash of link (link='%s', hash='%s'): %w", linkb64, hash, err)
+			}
+			if err := tx.Bucket([]byte(linkMetaTable)).Put([]byte(key), []byte(encodeLinkMeta(meta))); err != nil {
+				return "", false, fmt.Errorf("saving metadata of key ('%s'): %w", key, err)
+			}
+			return key, false, nil
+		}
+		// get a unique key for the link (if customKey is provided, it will be used)
+		key, deduped, err = getUniqueKey(claim, customKey)
+		if err != nil && !errors.Is(err, errKeyExists) {
+			return fmt.Errorf("getting unique key for link ('%s'): %w", linkb64, err)
+		}
+		return err
+	})
+	if err != nil {
+		key, deduped = "", false
+	}
+	return
+}
+
+// getLink returns the link for the given key.
+func (b *boltStore) getLink(key string) (link string, found bool, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		if val := bucketGet(tx, keyToLinkTable, key); val != nil {
+			link, found = string(val), true
+		}
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("retrieving link for key ('%s'): %w", key, err)
+	}
+	return
+}
+
+// exportLinks returns all the links in the store in the format: key,link
+func (b *boltStore) exportLinks() (out []string, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(keyToLinkTable)).ForEach(func(key, link []byte) error {
+			out = append(out, fmt.Sprintf("%s,%s", key, link))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting all links: %w", err)
+	}
+	return
+}
+
+// exportLinkMeta returns the metadata of all the links in the store by key.
+func (b *boltStore) exportLinkMeta() (map[string]linkMeta, error) {
+	encoded := map[string]string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(linkMetaTable)).ForEach(func(key, meta []byte) error {
+			encoded[string(key)] = string(meta)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting all metadata: %w", err)
+	}
+	return decodeLinkMetas(encoded)
+}
+
+// keyExists returns true if the given key exists in the given table.
+func (b *boltStore) keyExists(table, key string) (exists bool, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		exists = bucketGet(tx, table, key) != nil
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("key existence check (table='%s', key='%s'): %w", table, key, err)
+	}
+	return
+}
+
+// isLinkAlreadyShortened checks if the link is already shortened.
+func (b *boltStore) isLinkAlreadyShortened(linkb64 string) (
+	hash string, keys []string, exists bool, err error,
+) {
+	hash = rei.Sha256([]byte(linkb64))
+	err = b.db.View(func(tx *bolt.Tx) error {
+		keys = splitKeys(string(bucketGet(tx, linkExistsTable, hash)))
+		exists = len(keys) > 0
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("hash lookup ('%s'): %w", hash, err)
+	}
+	return
+}
+
+// updateLink points the key to a new link, moving the key to the new link's
+// hash and saving the old link in the key's history.
+func (b *boltStore) updateLink(key, linkb64 string) (found bool, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		link := string(bucketGet(tx, keyToLinkTable, key))
+		if len(link) < 1 {
+			return nil
+		}
+		found = true
+		if link == linkb64 {
+			return nil
+		}
+		if err := tx.Bucket([]byte(keyToLinkTable)).Put([]byte(key), []byte(linkb64)); err != nil {
+			return err
+		}
+		if err := bucketRemoveHashKey(tx, rei.Sha256([]byte(link)), key); err != nil {
+			return err
+		}
+		newHash := rei.Sha256([]byte(linkb64))
+		keys := addKey(string(bucketGet(tx, linkExistsTable, newHash)), key)
+		if err := tx.Bucket([]byte(linkExistsTable)).Put([]byte(newHash), []byte(keys)); err != nil {
+			return err
+		}
+		history := string(bucketGet(tx, linkHistoryTable, key)) + encodeLinkHistoryEntry(linkHistoryEntry{
+			Replaced: time.Now().Unix(),
+			Link:     link,
+		})
+		return tx.Bucket([]byte(linkHistoryTable)).Put([]byte(key), []byte(history))
+	})
+	if err != nil {
+		err = fmt.Errorf("updating key (key='%s', link='%s'): %w", key, linkb64, err)
+	}
+	return
+}
+
+// getLinkHistory returns the links the key pointed to before, oldest first.
+func (b *boltStore) getLinkHistory(key string) ([]linkHistoryEntry, error) {
+	var encoded string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		encoded = string(bucketGet(tx, linkHistoryTable, key))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("retrieving history for key ('%s'): %w", key, err)
+	}
+	return decodeLinkHistory(encoded)
+}
+
+// deleteLink removes the key, its link's hash, its metadata, its history, and
+// its stats from the store.
+func (b *boltStore) deleteLink(key string) (found bool, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) (err error) {
+		found, err = bucketRemove(tx, key)
+		return
+	})
+	if err != nil {
+		err = fmt.Errorf("deleting key ('%s'): %w", key, err)
+	}
+	return
+}
+
+// deleteExpiredLink is deleteLink, but only if the key has expired by now.
+func (b *boltStore) deleteExpiredLink(key string, now int64) (found bool, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) (err error) {
+		if !bucketExpired(tx, key, now) {
+			return nil
+		}
+		found, err = bucketRemove(tx, key)
+		return
+	})
+	if err != nil {
+		err = fmt.Errorf("deleting expired key ('%s'): %w", key, err)
+	}
+	return
+}
+
+// bucketRemove removes the key and everything about it.
+func bucketRemove(tx *bolt.Tx, key string) (bool, error) {
+	link := bucketGet(tx, keyToLinkTable, key)
+	if link == nil {
+		return false, nil
+	}
+	if err := bucketRemoveHashKey(tx, rei.Sha256(link), key); err != nil {
+		return false, err
+	}
+	for _, table := range []string{linkMetaTable, linkHistoryTable, keyToLinkTable} {
+		if err := tx.Bucket([]byte(table)).Delete([]byte(key)); err != nil {
+			return false, err
+		}
+	}
+	tables := []string{linkStatsTable(key), linkVisitorsTable(key, "")}
+	if stats := tx.Bucket([]byte(linkStatsTable(key))); stats != nil {
+		fields := []string{}
+		stats.ForEach(func(field, _ []byte) error {
+			fields = append(fields, string(field))
+			return nil
+		})
+		for _, day := range statsDays(fields) {
+			tables = append(tables, linkVisitorsTable(key, day))
+		}
+	}
+	for _, table := range tables {
+		if tx.Bucket([]byte(table)) == nil {
+			continue
+		}
+		if err := tx.DeleteBucket([]byte(table)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// bucketRemoveHashKey removes the key from the link hash's set of keys and
+// drops the hash when no keys are left.
+func bucketRemoveHashKey(tx *bolt.Tx, hash, key string) error {
+	hashes := tx.Bucket([]byte(linkExistsTable))
+	if rest := removeKey(string(hashes.Get([]byte(hash))), key); len(rest) > 0 {
+		return hashes.Put([]byte(hash), []byte(rest))
+	}
+	return hashes.Delete([]byte(hash))
+}
+
+// expiredKeys returns the keys that have expired by now.
+func (b *boltStore) expiredKeys(now int64) (keys []string, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(linkMetaTable)).ForEach(func(key, encoded []byte) error {
+			if meta, err := decodeLinkMeta(string(encoded)); err == nil && meta.expired(now) {
+				keys = append(keys, string(key))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting expired keys: %w", err)
+	}
+	return
+}
+
+// getLinkMeta returns the metadata of the key, empty if there is none.
+func (b *boltStore) getLinkMeta(key string) (meta linkMeta, err error) {
+	var encoded string
+	err = b.db.View(func(tx *bolt.Tx) error {
+		encoded = string(bucketGet(tx, linkMetaTable, key))
+		return nil
+	})
+	if err != nil {
+		return meta, fmt.Errorf("retrieving metadata for key ('%s'): %w", key, err)
+	}
+	return decodeLinkMeta(encoded)
+}
+
+// setLinkMeta saves the metadata of the key.
+func (b *boltStore) setLinkMeta(key string, meta linkMeta) (found bool, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		if bucketGet(tx, keyToLinkTable, key) == nil {
+			return nil
+		}
+		found = true
+		return tx.Bucket([]byte(linkMetaTable)).Put([]byte(key), []byte(encodeLinkMeta(meta)))
+	})
+	if err != nil {
+		err = fmt.Errorf("saving metadata for key ('%s'): %w", key, err)
+	}
+	return
+}
+
+// addLinkStats adds the counts to the key's stats fields.
+func (b *boltStore) addLinkStats(key string, counts map[string]int64) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if bucketGet(tx, keyToLinkTable, key) == nil {
+			return nil
+		}
+		stats, err := tx.CreateBucketIfNotExists([]byte(linkStatsTable(key)))
+		if err != nil {
+			return err
+		}
+		for field, count := range counts {
+			n, _ := strconv.ParseInt(string(stats.Get([]byte(field))), 10, 64) // we only store numbers here
+			if err := stats.Put([]byte(field), []byte(strconv.FormatInt(n+count, 10))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("saving stats for key ('%s'): %w", key, err)
+	}
+	return nil
+}
+
+// getLinkStats returns the key's stats fields, empty if there are none.
+func (b *boltStore) getLinkStats(key string) (map[string]int64, error) {
+	fields := map[string]string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		stats := tx.Bucket([]byte(linkStatsTable(key)))
+		if stats == nil {
+			return nil
+		}
+		return stats.ForEach(func(field, count []byte) error {
+			fields[string(field)] = string(count)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("retrieving stats for key ('%s'): %w", key, err)
+	}
+	return decodeStatsFields(fields)
+}
+
+// addLinkVisitors adds the hashed visitors of the day to the key's visitors,
+// every visitor is kept, so the counts are exact.
+func (b *boltStore) addLinkVisitors(key, day string, visitors []string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if bucketGet(tx, keyToLinkTable, key) == nil {
+			return nil
+		}
+		for _, table := range []string{linkVisitorsTable(key, ""), linkVisitorsTable(key, day)} {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(table))
+			if err != nil {
+				return err
+			}
+			for _, visitor := range visitors {
+				if err := bucket.Put([]byte(visitor), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("saving visitors for key ('%s'): %w", key, err)
+	}
+	return nil
+}
+
+// countLinkVisitors returns the number of the key's visitor days and unique
+// visitors of each of the given days.
+func (b *boltStore) countLinkVisitors(key string, days []string) (visitorDays int64, daily map[string]int64, err error) {
+	daily = make(map[string]int64, len(days))
+	err = b.db.View(func(tx *bolt.Tx) error {
+		count := func(table string) int64 {
+			if bucket := tx.Bucket([]byte(table)); bucket != nil {
+				return int64(bucket.Stats().KeyN)
+			}
+			return 0
+		}
+		visitorDays = count(linkVisitorsTable(key, ""))
+		for _, day := range days {
+			daily[day] = count(linkVisitorsTable(key, day))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("counting visitors for key ('%s'): %w", key, err)
+	}
+	return
+}
+
+// visitorSalt returns the salt of the visitors' hashes on the day.
+func (b *boltStore) visitorSalt(day, fresh string) (salt string, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		if val := bucketGet(tx, visitorSaltTable, day); val != nil {
+			salt = string(val)
+			return nil
+		}
+		// forget the salts of the days before yesterday, collected first as
+		// the cursor can't delete while iterating.
+		salts := tx.Bucket([]byte(visitorSaltTable))
+		oldest, old := oldestSaltDay(time.Now()), []string{}
+		salts.ForEach(func(other, _ []byte) error {
+			if string(other) < oldest {
+				old = append(old, string(other))
+			}
+			return nil
+		})
+		for _, other := range old {
+			if err := salts.Delete([]byte(other)); err != nil {
+				return err
+			}
+		}
+		salt = fresh
+		return salts.Put([]byte(day), []byte(fresh))
+	})
+	if err != nil {
+		err = fmt.Errorf("saving visitor salt for day ('%s'): %w", day, err)
+	}
+	return
+}
+
+// createToken saves the new API token under the name.
+func (b *boltStore) createToken(name string, token apiToken) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if bucketGet(tx, apiTokensTable, name) != nil {
+			return errTokenExists
+		}
+		if err := tx.Bucket([]byte(apiTokensUsedTable)).Delete([]byte(name)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(apiTokensTable)).Put([]byte(name), []byte(encodeApiToken(token)))
+	})
+	if err != nil && !errors.Is(err, errTokenExists) {
+		err = fmt.Errorf("saving token ('%s'): %w", name, err)
+	}
+	return err
+}
+
+// getToken returns the API token with the name.
+func (b *boltStore) getToken(name string) (token apiToken, found bool, err error) {
+	var encoded, lastUsed string
+	err = b.db.View(func(tx *bolt.Tx) error {
+		encoded = string(bucketGet(tx, apiTokensTable, name))
+		lastUsed = string(bucketGet(tx, apiTokensUsedTable, name))
+		return nil
+	})
+	if err != nil {
+		return token, false, fmt.Errorf("retrieving token ('%s'): %w", name, err)
+	}
+	if len(encoded) < 1 {
+		return token, false, nil
+	}
+	token, err = decodeApiToken(encoded, lastUsed)
+	return token, err == nil, err
+}
+
+// listTokens returns all the API tokens by name.
+func (b *boltStore) listTokens() (map[string]apiToken, error) {
+	encoded, lastUsed := map[string]string{}, map[string]string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte(apiTokensTable)).ForEach(func(name, value []byte) error {
+			encoded[string(name)] = string(value)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(apiTokensUsedTable)).ForEach(func(name, value []byte) error {
+			lastUsed[string(name)] = string(value)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing tokens: %w", err)
+	}
+	return decodeApiTokens(encoded, lastUsed)
+}
+
+// deleteToken removes the API token with the name.
+func (b *boltStore) deleteToken(name string) (found bool, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		found = bucketGet(tx, apiTokensTable, name) != nil
+		if err := tx.Bucket([]byte(apiTokensUsedTable)).Delete([]byte(name)); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(creationLimitsTable)).Delete([]byte(name)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(apiTokensTable)).Delete([]byte(name))
+	})
+	if err != nil {
+		err = fmt.Errorf("deleting token ('%s'): %w", name, err)
+	}
+	return
+}
+
+// touchToken saves that the API token was last used now.
+func (b *boltStore) touchToken(name string, now int64) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if bucketGet(tx, apiTokensTable, name) == nil {
+			return nil
+		}
+		return tx.Bucket([]byte(apiTokensUsedTable)).Put([]byte(name), []byte(strconv.FormatInt(now, 10)))
+	})
+	if err != nil {
+		return fmt.Errorf("saving last use of token ('%s'): %w", name, err)
+	}
+	return nil
+}
+
+// takeCreation counts a link creation of the API token now, if the limits
+// allow it.
+func (b *boltStore) takeCreation(name string, limits createLimits, now time.Time) (counter creationCounter, allowed bool, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if counter, err = decodeCreationCounter(string(bucketGet(tx, creationLimitsTable, name))); err != nil {
+			return err
+		}
+		allowed = counter.take(limits, now)
+		return tx.Bucket([]byte(creationLimitsTable)).Put([]byte(name), []byte(encodeCreationCounter(counter)))
+	})
+	if err != nil {
+		err = fmt.Errorf("counting creation of token ('%s'): %w", name, err)
+	}
+	return
+}
+
+// refundCreation gives back the quotas of a creation of the API token taken
+// now that didn't create a new link.
+func (b *boltStore) refundCreation(name string, now time.Time) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		encoded := bucketGet(tx, creationLimitsTable, name)
+		if encoded == nil {
+			return nil
+		}
+		counter, err := decodeCreationCounter(string(encoded))
+		if err != nil {
+			return err
+		}
+		counter.refund(now)
+		return tx.Bucket([]byte(creationLimitsTable)).Put([]byte(name), []byte(encodeCreationCounter(counter)))
+	})
+	if err != nil {
+		return fmt.Errorf("refunding creation of token ('%s'): %w", name, err)
+	}
+	return nil
+}
+
+// ping checks that the bolt database is still open.
+func (b *boltStore) ping(ctx context.Context) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// Close closes the bolt database.
+func (b *boltStore) Close() {
+	if err := b.db.Close(); err != nil {
+		log.Printf("closing bolt store: %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, func(t *testing.T) LinkStore {
+		return NewBoltStore(filepath.Join(t.TempDir(), "monokuma.db"))
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// maxCircuitCooldown is the longest a circuit stays open before trying
+	// redis again, the cooldown doubles every failed try until then.
+	maxCircuitCooldown = time.Minute
+)
+
+var (
+	// circuitFailures is how many failures in a row open the circuit.
+	circuitFailures *int
+	// circuitCooldown is how long the circuit stays open before trying redis
+	// again the first time.
+	circuitCooldown *time.Duration
+)
+
+// errCircuitOpen is returned instead of running redis commands while the
+// circuit is open.
+var errCircuitOpen = errors.New("redis circuit is open, not trying until the cooldown is over")
+
+// circuitState is the state of a circuitBreaker.
+type circuitState uint8
+
+const (
+	// circuitClosed lets all the commands through.
+	circuitClosed circuitState = iota
+	// circuitOpen fails all the commands right away.
+	circuitOpen
+	// circuitHalfOpen lets the commands through again to see if redis is
+	// back, the first one to finish decides.
+	circuitHalfOpen
+)
+
+// circuitStateNames are the names of the circuit states, for humans.
+var circuitStateNames = map[circuitState]string{
+	circuitClosed:   "closed",
+	circuitOpen:     "open",
+	circuitHalfOpen: "half-open",
+}
+
+// circuitBreaker is a redis hook that stops sending commands to redis after
+// too many failures in a row, so callers fail fast instead of waiting on a
+// dead server. After a cooldown, it lets the commands through again, if the
+// first one works the circuit closes, otherwise it opens again for twice as
+// long. Not just one command is let through, as new connections run their own
+// commands (like AUTH) through the hooks before the command itself.
+type circuitBreaker struct {
+	// conn is the name of the connection, like connPusher.
+	conn string
+
+	// mu guards the fields below.
+	mu sync.Mutex
+	// state is the current state.
+	state circuitState
+	// failures is how many commands failed in a row.
+	failures int
+	// openedAt is when the circuit opened last.
+	openedAt time.Time
+	// cooldown is how long the circuit stays open this time.
+	cooldown time.Duration
+}
+
+// newCircuitBreaker creates a closed circuit breaker for the connection.
+func newCircuitBreaker(conn string) *circuitBreaker {
+	return &circuitBreaker{conn: conn, cooldown: *circuitCooldown}
+}
+
+// allow returns true if the command can be sent to redis.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitOpen {
+		return true
+	}
+	if time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.setState(circuitHalfOpen)
+	return true
+}
+
+// done records how the command went.
+func (b *circuitBreaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isRedisFailure(err) {
+		b.failures = 0
+		if b.state != circuitClosed {
+			b.cooldown = *circuitCooldown
+			b.setState(circuitClosed)
+		}
+		return
+	}
+	b.failures++
+	switch {
+	case b.state == circuitHalfOpen:
+		b.cooldown = min(2*b.cooldown, maxCircuitCooldown)
+		b.openedAt = time.Now()
+		log.Printf("redis on %s is still down: %v", b.conn, err)
+		b.setState(circuitOpen)
+	case b.state == circuitClosed && b.failures >= *circuitFailures:
+		b.openedAt = time.Now()
+		log.Printf("redis on %s is down: %v", b.conn, err)
+		b.setState(circuitOpen)
+	}
+}
+
+// setState moves the circuit to the state and logs it, must hold mu.
+func (b *circuitBreaker) setState(state circuitState) {
+	log.Printf("redis circuit on %s is %s (was %s, %d failures in a row, cooldown %s)",
+		b.conn, circuitStateNames[state], circuitStateNames[b.state], b.failures, b.cooldown)
+	b.state = state
+	open := 0.0
+	if state == circuitOpen {
+		open = 1
+	}
+	redisCircuitOpen.WithLabelValues(b.conn).Set(open)
+}
+
+// isRedisFailure returns true if the error means redis couldn't be reached.
+// Missing keys and errors from redis itself mean it's there.
+func isRedisFailure(err error) bool {
+	var reply redis.Error
+	return err != nil && !errors.Is(err, redis.Nil) && !errors.As(err, &reply)
+}
+
+// DialHook doesn't do anything, failed dials fail the commands anyway.
+func (b *circuitBreaker) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook fails the command right away if the circuit is open.
+func (b *circuitBreaker) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !b.allow() {
+			cmd.SetErr(errCircuitOpen)
+			return errCircuitOpen
+		}
+		err := next(ctx, cmd)
+		b.done(err)
+		return err
+	}
+}
+
+// ProcessPipelineHook fails the pipeline right away if the circuit is open.
+func (b *circuitBreaker) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !b.allow() {
+			for _, cmd := range cmds {
+				cmd.SetErr(errCircuitOpen)
+			}
+			return errCircuitOpen
+		}
+		err := next(ctx, cmds)
+		b.done(err)
+		return err
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configFlag is the name of the flag with the config file, it can't be set
+	// from the config file itself.
+	configFlag = "config"
+	// configEnvPrefix prefixes the environment variables that override the
+	// settings, like MONOKUMA_KEY_SIZE for -key-size.
+	configEnvPrefix = "MONOKUMA_"
+)
+
+var (
+	// configPath is the YAML config file, empty for none.
+	configPath *string
+
+	// commandLine are the flags given on the command line, they win over the
+	// config file and the environment, even after a reload.
+	commandLine = map[string]bool{}
+
+	// settingsMu guards the settings that are reloaded on SIGHUP, see setting.
+	settingsMu sync.RWMutex
+)
+
+// reloadableSettings are the settings that are changed on SIGHUP without a
+// restart, the rest are only read at startup.
+var reloadableSettings = []string{
+	"agent-rules", "aliases", "alphabet", "auth", "blocklist", "cache-ttl", "cors-origins", "create-burst",
+	"create-daily", "create-monthly", "create-rate", "gen-tries", "key-size", "miss-burst", "miss-rate", "no-auth",
+	"redirect-burst", "redirect-rate", "redirect-trusted",
+}
+
+// commandFlags are the flags that run a command and exit instead of serving,
+// they can only be given on the command line, or every start would run them.
+var commandFlags = []string{
+	"migrate-namespace", "token-create", "token-limits", "token-list", "token-revoke", "token-scopes",
+}
+
+// setting returns the current value of a setting that can be reloaded.
+func setting[T any](value *T) T {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return *value
+}
+
+// configEnv returns the name of the environment variable of the setting.
+func configEnv(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configValues returns the values all the settings should have: the defaults,
+// overridden by the config file at path, then by the environment, then by
+// the command line. The values are formatted like the flags format them, so
+// they can be compared to the current ones.
+func configValues(path string) (map[string]string, error) {
+	values := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.DefValue
+	})
+	delete(values, configFlag)
+	for _, name := range commandFlags {
+		delete(values, name)
+	}
+
+	if len(path) > 0 {
+		fromFile, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range fromFile {
+			if _, ok := values[name]; !ok {
+				return nil, fmt.Errorf("config %s: unknown setting %s", path, name)
+			}
+			if values[name], err = normalizeSetting(name, value); err != nil {
+				return nil, fmt.Errorf("config %s: %w", path, err)
+			}
+		}
+	}
+
+	for name := range values {
+		value, ok := os.LookupEnv(configEnv(name))
+		if !ok {
+			continue
+		}
+		var err error
+		if values[name], err = normalizeSetting(name, value); err != nil {
+			return nil, fmt.Errorf("env var %s: %w", configEnv(name), err)
+		}
+	}
+
+	for name := range commandLine {
+		values[name] = flag.Lookup(name).Value.String()
+	}
+	return values, nil
+}
+
+// readConfigFile reads the settings from the YAML config file, by the names
+// of their flags. Lists are joined with commas, like "cors-origins: [a, b]".
+func readConfigFile(path string) (map[string]string, error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	var decoded map[string]any
+	if err := yaml.Unmarshal(encoded, &decoded); err != nil {
+		return nil, fmt.Errorf("decoding config %s: %w", path, err)
+	}
+	values := make(map[string]string, len(decoded))
+	for name, value := range decoded {
+		switch value := value.(type) {
+		case nil:
+			values[name] = ""
+		case []any:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		case map[string]any:
+			return nil, fmt.Errorf("config %s: setting %s can't be a map", path, name)
+		default:
+			values[name] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// normalizeSetting checks that the value fits the setting's flag and formats
+// it like the flag would, so "60s" is "1m0s".
+func normalizeSetting(name, value string) (string, error) {
+	getter, _ := flag.Lookup(name).Value.(flag.Getter) // all the std flags are
+	normalized, err := value, error(nil)
+	switch getter.Get().(type) {
+	case bool:
+		var b bool
+		b, err = strconv.ParseBool(value)
+		normalized = strconv.FormatBool(b)
+	case int:
+		var n int64
+		n, err = strconv.ParseInt(value, 0, strconv.IntSize)
+		normalized = strconv.FormatInt(n, 10)
+	case int64:
+		var n int64
+		n, err = strconv.ParseInt(value, 0, 64)
+		normalized = strconv.FormatInt(n, 10)
+	case time.Duration:
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		normalized = d.String()
+	}
+	if err != nil {
+		return "", fmt.Errorf("setting %s ('%s') is invalid: %w", name, value, err)
+	}
+	return normalized, nil
+}
+
+// loadConfig sets the flags that weren't given on the command line from the
+// config file and the environment, and checks all of them, at startup.
+func loadConfig() error {
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+	values, err := configValues(*configPath)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("setting %s: %w", name, err)
+		}
+	}
+	return validateConfig()
+}
+
+// validateConfig checks the settings, so bad ones fail at startup (or the
+// reload) instead of on the first request.
+func validateConfig() error {
+	errs := []error{}
+	if *port < 1 || *port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d is invalid, needs to be between 1 and 65535", *port))
+	}
+	if !slices.Contains([]string{storeRedis, storeMemory, storeBolt}, *storeBackend) {
+		errs = append(errs, fmt.Errorf("store %s is invalid, must be one of: %s, %s, %s",
+			*storeBackend, storeRedis, storeMemory, storeBolt))
+	}
+	// the generated keys have to be valid keys too.
+	if *keysize < 3 || *keysize > customKeyMaxLength {
+		errs = append(errs, fmt.Errorf("key size %d is invalid, needs to be between 3 and %d",
+			*keysize, customKeyMaxLength))
+	}
+	if !alphabetRegexp.MatchString(*alphabet) {
+		errs = append(errs, fmt.Errorf("alphabet %s is invalid, needs letters, digits, or dashes", *alphabet))
+	}
+	if *maxNumGenTries < 1 {
+		errs = append(errs, fmt.Errorf("gen tries %d is invalid, needs at least one", *maxNumGenTries))
+	}
+	if *noAuth && len(*auth) > 0 {
+		errs = append(errs, errors.New("auth token is given, but so is no-auth"))
+	}
+	// not serverLimits, a reload holds settingsMu already.
+	if err := validateLimits(createLimits{
+		Rate: *createRate, Burst: *createBurst, Daily: *createDaily, Monthly: *createMonthly,
+	}); err != nil {
+		errs = append(errs, err)
+	}
+	for _, limit := range []struct {
+		name        string
+		rate, burst int
+	}{
+		{"redirect", *redirectRate, *redirectBurst},
+		{"miss", *missRate, *missBurst},
+	} {
+		if limit.rate < 0 {
+			errs = append(errs, fmt.Errorf("%s rate %d is invalid, can't be negative", limit.name, limit.rate))
+		}
+		if limit.rate > 0 && limit.burst < 1 {
+			errs = append(errs, fmt.Errorf("%s burst %d is invalid, needs at least one with a rate",
+				limit.name, limit.burst))
+		}
+	}
+	if _, err := parseTrustedNets(*redirectTrusted); err != nil {
+		errs = append(errs, err)
+	}
+	for _, interval := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"cache-ttl", *cacheTTL},
+		{"ready-timeout", *readyTimeout},
+		{"stats-interval", *statsInterval},
+		{"store-check-interval", *storeCheckInterval},
+		{"sweep-interval", *sweepInterval},
+	} {
+		if interval.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s %s is invalid, needs to be positive", interval.name, interval.value))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reloadConfig reads the config file and the environment again and applies
+// the reloadable settings that changed. The other changes are logged as
+// needing a restart. If anything is wrong, nothing is changed.
+func reloadConfig() error {
+	values, err := configValues(*configPath)
+	if err != nil {
+		return err
+	}
+	reload, restart := []string{}, []string{}
+	for name, value := range values {
+		if flag.Lookup(name).Value.String() == value {
+			continue
+		}
+		if slices.Contains(reloadableSettings, name) {
+			reload = append(reload, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	slices.Sort(reload)
+	slices.Sort(restart)
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	old := map[string]string{}
+	for _, name := range reload {
+		old[name] = flag.Lookup(name).Value.String()
+		flag.Set(name, values[name]) // can't fail, the value was normalized
+	}
+	// the files are read again even if they're the same, they might have changed.
+	rules, err := loadAgentRules(*agentRulesPath)
+	var blocked map[string]bool
+	if err == nil {
+		blocked, err = loadBlocklist(*blocklistPath)
+	}
+	if err == nil {
+		err = validateConfig()
+	}
+	if err != nil {
+		for name, value := range old {
+			flag.Set(name, value)
+		}
+		return err
+	}
+	agentRules, blockedHosts = rules, blocked
+	trustedNets, _ = parseTrustedNets(*redirectTrusted) // checked by validateConfig
+	corsRules.Store(newCors(*corsOrigins))
+
+	// no values, the auth token is one of them.
+	if len(reload) > 0 {
+		log.Printf("reloaded config, changed: %s", strings.Join(reload, ", "))
+	} else {
+		log.Printf("reloaded config, no settings changed")
+	}
+	if len(restart) > 0 {
+		log.Printf("not reloaded, changed but needs a restart: %s", strings.Join(restart, ", "))
+	}
+	return nil
+}
+
+// reloadOnHangup reloads the config on every SIGHUP, forever.
+func reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := reloadConfig(); err != nil {
+			log.Printf("reloading config, keeping the old one: %v", err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the flags are defined in main, so the tests have their own of every type.
+func init() {
+	flag.Bool("config-test-bool", false, "")
+	flag.Int("config-test-int", 0, "")
+	flag.Int64("config-test-int64", 0, "")
+	flag.Duration("config-test-duration", 0, "")
+	flag.String("config-test-string", "", "")
+	for _, name := range commandFlags {
+		flag.String(name, "", "")
+	}
+}
+
+func TestNormalizeSetting(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		ok    bool
+	}{
+		{"config-test-bool", "1", "true", true},
+		{"config-test-bool", "FALSE", "false", true},
+		{"config-test-bool", "yes", "", false},
+		{"config-test-int", "0x10", "16", true},
+		{"config-test-int", "-3", "-3", true},
+		{"config-test-int", "1.5", "", false},
+		{"config-test-int64", "5000000000", "5000000000", true},
+		{"config-test-int64", "many", "", false},
+		{"config-test-duration", "60s", "1m0s", true},
+		{"config-test-duration", "1h30m", "1h30m0s", true},
+		{"config-test-duration", "5", "", false},
+		{"config-test-string", " anything, at all ", " anything, at all ", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name+"="+test.value, func(t *testing.T) {
+			got, err := normalizeSetting(test.name, test.value)
+			if (err == nil) != test.ok {
+				t.Fatalf("normalizeSetting(%s, %q) error = %v, want ok %v", test.name, test.value, err, test.ok)
+			}
+			if got != test.want {
+				t.Errorf("normalizeSetting(%s, %q) = %q, want %q", test.name, test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   map[string]string
+		ok     bool
+	}{
+		{
+			name:   "values",
+			config: "port: 8080\nno-auth: true\ncache-ttl: 90s\nurl: https://example.com/\n",
+			want:   map[string]string{"port": "8080", "no-auth": "true", "cache-ttl": "90s", "url": "https://example.com/"},
+			ok:     true,
+		},
+		{
+			name:   "lists are comma-separated",
+			config: "cors-origins:\n  - https://a.example\n  - https://b.example\nalphabet: [a, b, \"1\"]\n",
+			want:   map[string]string{"cors-origins": "https://a.example,https://b.example", "alphabet": "a,b,1"},
+			ok:     true,
+		},
+		{
+			name:   "empty values",
+			config: "auth:\ncors-origins: []\n",
+			want:   map[string]string{"auth": "", "cors-origins": ""},
+			ok:     true,
+		},
+		{
+			name:   "empty file",
+			config: "",
+			want:   map[string]string{},
+			ok:     true,
+		},
+		{
+			name:   "maps aren't settings",
+			config: "redis:\n  host: localhost\n",
+			ok:     false,
+		},
+		{
+			name:   "bad yaml",
+			config: "port: [8080\n",
+			ok:     false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "monokuma.yaml")
+			if err := os.WriteFile(path, []byte(test.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readConfigFile(path)
+			if (err == nil) != test.ok {
+				t.Fatalf("readConfigFile() error = %v, want ok %v", err, test.ok)
+			}
+			if test.ok && !maps.Equal(got, test.want) {
+				t.Errorf("readConfigFile() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := readConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("reading a missing config succeeded")
+	}
+}
+
+func TestConfigValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "monokuma.yaml")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv(configEnv("config-test-int"), "0x20")
+	t.Setenv(configEnv("token-create"), "ci")
+	t.Setenv(configEnv(configFlag), "other.yaml")
+
+	write("config-test-int: 7\nconfig-test-duration: 90s\n")
+	values, err := configValues(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the environment wins over the file.
+	if values["config-test-int"] != "32" || values["config-test-duration"] != "1m30s" {
+		t.Errorf("values = %v, want config-test-int 32 and config-test-duration 1m30s", values)
+	}
+	for _, name := range append([]string{configFlag}, commandFlags...) {
+		if value, ok := values[name]; ok {
+			t.Errorf("values has %s = %q, want it left to the command line", name, value)
+		}
+	}
+
+	for _, config := range []string{"token-list: true\n", "migrate-namespace: true\n", "config: other.yaml\n", "nope: 1\n"} {
+		write(config)
+		if _, err := configValues(path); err == nil {
+			t.Errorf("config %q was read, want an unknown setting", config)
+		}
+	}
+}
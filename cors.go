@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-chi/cors"
+)
+
+var (
+	// corsOrigins are the comma-separated origins allowed to call the API from
+	// browsers, "*" for any, empty for none.
+	corsOrigins *string
+
+	// corsRules are the CORS rules of corsOrigins, nil for none, replaced on
+	// reload.
+	corsRules atomic.Pointer[cors.Cors]
+)
+
+// parseOrigins splits the comma-separated origins.
+func parseOrigins(origins string) []string {
+	out := []string{}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); len(origin) > 0 {
+			out = append(out, origin)
+		}
+	}
+	return out
+}
+
+// newCors creates the CORS rules for the origins. No origins are no rules, the
+// cors package would allow any origin instead.
+func newCors(origins string) *cors.Cors {
+	allowed := parseOrigins(origins)
+	if len(allowed) < 1 {
+		return nil
+	}
+	return cors.New(cors.Options{
+		AllowedOrigins: allowed,
+		AllowedMethods: []string{
+			http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+		},
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type"},
+		ExposedHeaders: []string{"Link"},
+		MaxAge:         300,
+	})
+}
+
+// corsMiddleware applies the current CORS rules, if there are any.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := corsRules.Load()
+		if rules == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rules.Handler(next).ServeHTTP(w, r)
+	})
+}
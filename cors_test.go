@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCorsMiddleware(t *testing.T) {
+	t.Cleanup(func() { corsRules.Store(nil) })
+	handler := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		origins string
+		origin  string
+		allowed string
+	}{
+		{"", "https://example.com", ""},
+		{" , ", "https://example.com", ""},
+		{"https://example.com", "https://example.com", "https://example.com"},
+		{"https://example.com", "https://evil.example", ""},
+		{"https://a.example, https://example.com", "https://example.com", "https://example.com"},
+		{"*", "https://evil.example", "*"},
+	}
+	for _, test := range tests {
+		corsRules.Store(newCors(test.origins))
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/links/abc", nil)
+		r.Header.Set("Origin", test.origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if allowed := w.Header().Get("Access-Control-Allow-Origin"); allowed != test.allowed {
+			t.Errorf("origins %q: %s is allowed as %q, want %q", test.origins, test.origin, allowed, test.allowed)
+		}
+		if credentials := w.Header().Get("Access-Control-Allow-Credentials"); len(credentials) > 0 {
+			t.Errorf("origins %q: credentials are allowed", test.origins)
+		}
+	}
+}
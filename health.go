@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// readyTimeout is how long the store has to answer a readiness check.
+	readyTimeout *time.Duration
+	// readyWhenDegraded is whether we're ready while the store is down, but
+	// the redirects are served from the snapshot.
+	readyWhenDegraded *bool
+)
+
+// storeHealth is what we know about the health of the store, see readyz.
+var storeHealth = &backendHealth{}
+
+// backendHealth keeps the last failure of the store, from the readiness
+// checks or from the store itself (like the redis keep-alive pings).
+type backendHealth struct {
+	// mu guards the fields below.
+	mu sync.Mutex
+	// lastError is the last failure, empty if there was none.
+	lastError string
+	// lastErrorAt is when the last failure happened.
+	lastErrorAt time.Time
+}
+
+// recordError remembers the failure of the store.
+func (h *backendHealth) recordError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastError, h.lastErrorAt = err.Error(), time.Now()
+}
+
+// last returns the last failure and when it happened.
+func (h *backendHealth) last() (string, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastError, h.lastErrorAt
+}
+
+// apiReadiness is the answer of readyz.
+type apiReadiness struct {
+	// Status is "ready", "degraded" (the store is down, but the redirects
+	// are served from the snapshot), or "unavailable".
+	Status string `json:"status"`
+	// Store is the name of the storage backend.
+	Store string `json:"store"`
+	// LatencyMs is how long the store took to answer, in milliseconds.
+	LatencyMs float64 `json:"latency_ms"`
+	// Error is why the store didn't answer, if it didn't.
+	Error string `json:"error,omitempty"`
+	// LastError is the last failure of the store, even if it's fine now.
+	LastError string `json:"last_error,omitempty"`
+	// LastErrorAt is when the last failure happened.
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// SnapshotLinks is the number of links in the snapshot.
+	SnapshotLinks int `json:"snapshot_links"`
+	// SnapshotTaken is when the snapshot was taken.
+	SnapshotTaken *time.Time `json:"snapshot_taken,omitempty"`
+}
+
+// healthz answers as long as the process is alive.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// readyz answers with 200 OK if the store answers in time, and with 503
+// Service Unavailable otherwise, so load balancers can route around us. If the
+// redirects can be served from the snapshot, it's "degraded", which is only
+// ready with readyWhenDegraded.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), *readyTimeout)
+	defer cancel()
+	start := time.Now()
+	err := monomi.ping(ctx)
+	latency := time.Since(start)
+	if err != nil {
+		storeHealth.recordError(fmt.Errorf("readiness check: %w", err))
+	}
+
+	out := apiReadiness{
+		Status:    "ready",
+		Store:     *storeBackend,
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+	}
+	if lastError, lastErrorAt := storeHealth.last(); len(lastError) > 0 {
+		out.LastError, out.LastErrorAt = lastError, unixTime(lastErrorAt.Unix())
+	}
+	links, taken := snapshot.size()
+	out.SnapshotLinks = links
+	if links > 0 {
+		out.SnapshotTaken = unixTime(taken.Unix())
+	}
+	status := http.StatusOK
+	switch {
+	case err != nil && links > 0:
+		out.Status, out.Error = "degraded", err.Error()
+		if !*readyWhenDegraded {
+			status = http.StatusServiceUnavailable
+		}
+	case err != nil:
+		out.Status, out.Error = "unavailable", err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, out)
+}
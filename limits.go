@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// creationLimitsTable is the name of the table that maps the names of the
+	// API tokens to their creation counters, see creationCounter.
+	creationLimitsTable = "creationlimits"
+
+	// monthLayout is the layout of the months the monthly quotas count, like
+	// "2025-01".
+	monthLayout = "2006-01"
+)
+
+var (
+	// createRate is how many links a token can create per minute, 0 for no limit.
+	createRate *int
+	// createBurst is how many links a token can create at once.
+	createBurst *int
+	// createDaily is how many links a token can create per day (UTC), 0 for no quota.
+	createDaily *int64
+	// createMonthly is how many links a token can create per month (UTC), 0
+	// for no quota.
+	createMonthly *int64
+)
+
+// createLimits are the limits of the links a token can create: a token bucket
+// that holds Burst creations and refills Rate of them per minute, and quotas
+// per day and month. Zeros are no limit.
+type createLimits struct {
+	// Rate is how many links can be created per minute.
+	Rate int
+	// Burst is how many links can be created at once.
+	Burst int
+	// Daily is how many links can be created per day (UTC).
+	Daily int64
+	// Monthly is how many links can be created per month (UTC).
+	Monthly int64
+}
+
+// tokenLimits are the limits of a token that aren't the server's. They're
+// kept with the token, nil are the server's.
+type tokenLimits struct {
+	// Rate overrides -create-rate.
+	Rate *int `json:"rate,omitempty"`
+	// Burst overrides -create-burst.
+	Burst *int `json:"burst,omitempty"`
+	// Daily overrides -create-daily.
+	Daily *int64 `json:"daily,omitempty"`
+	// Monthly overrides -create-monthly.
+	Monthly *int64 `json:"monthly,omitempty"`
+}
+
+// serverLimits returns the server's limits, see -create-rate and friends.
+func serverLimits() createLimits {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return createLimits{Rate: *createRate, Burst: *createBurst, Daily: *createDaily, Monthly: *createMonthly}
+}
+
+// over returns the limits with the token's over them.
+func (token tokenLimits) over(limits createLimits) createLimits {
+	if token.Rate != nil {
+		limits.Rate = *token.Rate
+	}
+	if token.Burst != nil {
+		limits.Burst = *token.Burst
+	}
+	if token.Daily != nil {
+		limits.Daily = *token.Daily
+	}
+	if token.Monthly != nil {
+		limits.Monthly = *token.Monthly
+	}
+	return limits
+}
+
+// String returns the limits like parseTokenLimits takes them, empty for none.
+func (token tokenLimits) String() string {
+	parts := []string{}
+	if token.Rate != nil {
+		parts = append(parts, "rate="+strconv.Itoa(*token.Rate))
+	}
+	if token.Burst != nil {
+		parts = append(parts, "burst="+strconv.Itoa(*token.Burst))
+	}
+	if token.Daily != nil {
+		parts = append(parts, "daily="+strconv.FormatInt(*token.Daily, 10))
+	}
+	if token.Monthly != nil {
+		parts = append(parts, "monthly="+strconv.FormatInt(*token.Monthly, 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseTokenLimits parses the comma-separated limits of a token, like
+// "rate=10,daily=1000", empty for the server's.
+func parseTokenLimits(limits string) (tokenLimits, error) {
+	out := tokenLimits{}
+	if len(limits) < 1 {
+		return out, nil
+	}
+	for _, part := range strings.Split(limits, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || n < 0 {
+			return out, fmt.Errorf("limit %s is invalid, needs a count that's not negative", part)
+		}
+		switch name {
+		case "rate":
+			rate := int(n)
+			out.Rate = &rate
+		case "burst":
+			burst := int(n)
+			out.Burst = &burst
+		case "daily":
+			out.Daily = &n
+		case "monthly":
+			out.Monthly = &n
+		default:
+			return out, fmt.Errorf("limit %s is invalid, needs to be one of rate, burst, daily, or monthly", name)
+		}
+	}
+	return out, nil
+}
+
+// validateLimits checks the limits, the bucket has to fit one creation.
+func validateLimits(limits createLimits) error {
+	if limits.Rate < 0 || limits.Daily < 0 || limits.Monthly < 0 {
+		return errors.New("create limits can't be negative")
+	}
+	if limits.Rate > 0 && limits.Burst < 1 {
+		return fmt.Errorf("create burst %d is invalid, needs at least one with a rate", limits.Burst)
+	}
+	return nil
+}
+
+// creationCounter counts the links a token created, as kept in
+// creationLimitsTable.
+type creationCounter struct {
+	// Tokens are the creations left in the bucket.
+	Tokens float64 `json:"tokens"`
+	// At is the unix time in milliseconds when the bucket was last refilled.
+	At int64 `json:"at"`
+	// Day is the day (UTC) of Daily.
+	Day string `json:"day"`
+	// Daily is how many links were created on Day.
+	Daily int64 `json:"daily"`
+	// Month is the month (UTC) of Monthly, see monthLayout.
+	Month string `json:"month"`
+	// Monthly is how many links were created in Month.
+	Monthly int64 `json:"monthly"`
+}
+
+// encodeCreationCounter encodes the counter for storing.
+func encodeCreationCounter(counter creationCounter) string {
+	encoded, _ := json.Marshal(counter) // can't fail, it's a plain struct
+	return string(encoded)
+}
+
+// decodeCreationCounter decodes the stored counter, empty string is a new one.
+func decodeCreationCounter(encoded string) (counter creationCounter, err error) {
+	if len(encoded) < 1 {
+		counter.At = -1
+		return
+	}
+	if err = json.Unmarshal([]byte(encoded), &counter); err != nil {
+		err = fmt.Errorf("decoding creation counter ('%s'): %w", encoded, err)
+	}
+	return
+}
+
+// take counts a creation now if the limits allow it. It returns whether they
+// did. Just like takeCreationScript, which does it in redis.
+func (counter *creationCounter) take(limits createLimits, now time.Time) bool {
+	at := now.UnixMilli()
+	// a new bucket is full, otherwise it refills since the last time.
+	if counter.At < 0 {
+		counter.Tokens = float64(limits.Burst)
+	} else if at > counter.At {
+		counter.Tokens += float64(at-counter.At) * float64(limits.Rate) / float64(time.Minute.Milliseconds())
+	}
+	counter.Tokens = min(counter.Tokens, float64(limits.Burst))
+	counter.At = at
+
+	day, month := now.UTC().Format(time.DateOnly), now.UTC().Format(monthLayout)
+	if counter.Day != day {
+		counter.Day, counter.Daily = day, 0
+	}
+	if counter.Month != month {
+		counter.Month, counter.Monthly = month, 0
+	}
+
+	if (limits.Rate > 0 && counter.Tokens < 1) ||
+		(limits.Daily > 0 && counter.Daily >= limits.Daily) ||
+		(limits.Monthly > 0 && counter.Monthly >= limits.Monthly) {
+		return false
+	}
+	if limits.Rate > 0 {
+		counter.Tokens--
+	}
+	counter.Daily++
+	counter.Monthly++
+	return true
+}
+
+// refund gives back the quotas of a creation taken now that didn't create a
+// new link after all. The rate isn't given back, it counts the requests.
+func (counter *creationCounter) refund(now time.Time) {
+	if counter.Day == now.UTC().Format(time.DateOnly) && counter.Daily > 0 {
+		counter.Daily--
+	}
+	if counter.Month == now.UTC().Format(monthLayout) && counter.Monthly > 0 {
+		counter.Monthly--
+	}
+}
+
+// creationContextKey is the context key of whether the request created a new
+// link, see markCreated.
+type creationContextKey struct{}
+
+// markCreated tells limitCreations that the request created a new link, so it
+// counts against the quotas.
+func markCreated(r *http.Request) {
+	if created, ok := r.Context().Value(creationContextKey{}).(*bool); ok {
+		*created = true
+	}
+}
+
+// rateLimit is one of the limits, as the RateLimit headers give it.
+type rateLimit struct {
+	// name is the name of the limit, like "rate".
+	name string
+	// limit is how many creations the limit allows.
+	limit int64
+	// remaining is how many creations are left.
+	remaining int64
+	// reset is when the limit is back to full.
+	reset time.Duration
+	// retry is when the next creation is allowed, 0 if it is now.
+	retry time.Duration
+}
+
+// rateLimits returns the limits of the counter that are there, how much of
+// them is left and when.
+func rateLimits(counter creationCounter, limits createLimits, now time.Time) []rateLimit {
+	out := []rateLimit{}
+	if limits.Rate > 0 {
+		perToken := time.Minute / time.Duration(limits.Rate)
+		out = append(out, rateLimit{
+			name:      "rate",
+			limit:     int64(limits.Burst),
+			remaining: int64(counter.Tokens),
+			reset:     time.Duration((float64(limits.Burst) - counter.Tokens) * float64(perToken)),
+			retry:     time.Duration(max(0, 1-counter.Tokens) * float64(perToken)),
+		})
+	}
+	utc := now.UTC()
+	if limits.Daily > 0 {
+		tomorrow := time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+		out = append(out, quotaLimit("daily", limits.Daily, counter.Daily, tomorrow.Sub(now)))
+	}
+	if limits.Monthly > 0 {
+		nextMonth := time.Date(utc.Year(), utc.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		out = append(out, quotaLimit("monthly", limits.Monthly, counter.Monthly, nextMonth.Sub(now)))
+	}
+	return out
+}
+
+// quotaLimit returns the quota that resets in reset, as a limit.
+func quotaLimit(name string, limit, used int64, reset time.Duration) rateLimit {
+	quota := rateLimit{name: name, limit: limit, remaining: max(0, limit-used), reset: reset}
+	if quota.remaining < 1 {
+		quota.retry = reset
+	}
+	return quota
+}
+
+// seconds returns the duration in whole seconds, rounded up.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// limitCreations answers 429 Too Many Requests if the token of the request
+// can't create another link now, see createLimits. The limits left are given
+// in the RateLimit-Limit, RateLimit-Remaining, and RateLimit-Reset headers, of
+// the one with the least left (and the longest to wait). Requests that don't
+// create a new link, see markCreated, get their quotas back. Requests without
+// auth have no limits.
+func limitCreations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current, _ := r.Context().Value(tokenContextKey{}).(requestToken)
+		if len(current.name) < 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limits := current.token.Limits.over(serverLimits())
+		now := time.Now()
+		counter, allowed, err := monomi.takeCreation(current.name, limits, now)
+		if err != nil {
+			code := Uncategorized
+			if degraded.Load() {
+				code = StoreUnavailable
+			}
+			writeError(w, r, code, fmt.Errorf("critical failure during creation counting: %v", err))
+			return
+		}
+
+		all := rateLimits(counter, limits, now)
+		if len(all) > 0 {
+			tightest := all[0]
+			for _, limit := range all[1:] {
+				if limit.remaining < tightest.remaining ||
+					(limit.remaining == tightest.remaining && limit.reset > tightest.reset) {
+					tightest = limit
+				}
+			}
+			w.Header().Set("RateLimit-Limit", strconv.FormatInt(tightest.limit, 10))
+			w.Header().Set("RateLimit-Remaining", strconv.FormatInt(tightest.remaining, 10))
+			w.Header().Set("RateLimit-Reset", seconds(tightest.reset))
+		}
+		if !allowed {
+			retry, exceeded := time.Duration(0), []string{}
+			for _, limit := range all {
+				if limit.retry > 0 {
+					retry = max(retry, limit.retry)
+					exceeded = append(exceeded, limit.name)
+				}
+			}
+			for _, name := range exceeded {
+				creationsLimited.WithLabelValues(name).Inc()
+			}
+			w.Header().Set("Retry-After", seconds(retry))
+			writeError(w, r, RateLimited, fmt.Errorf("token %s is over its %s limit, try again in %s",
+				current.name, strings.Join(exceeded, " and "), seconds(retry)+"s"))
+			return
+		}
+		created := false
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), creationContextKey{}, &created)))
+		if !created {
+			if err := monomi.refundCreation(current.name, now); err != nil {
+				log.Printf("refunding creation of token %s: %v", current.name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// testNow is noon of a day in the middle of a month, in UTC.
+var testNow = time.Date(2025, time.March, 15, 12, 0, 0, 0, time.UTC)
+
+func TestCreationCounterTake(t *testing.T) {
+	today, month := testNow.Format(time.DateOnly), testNow.Format(monthLayout)
+	at := testNow.UnixMilli()
+	tests := []struct {
+		name    string
+		counter creationCounter
+		limits  createLimits
+		allowed bool
+		want    creationCounter
+	}{
+		{
+			name:    "new bucket is full",
+			counter: creationCounter{At: -1},
+			limits:  createLimits{Rate: 60, Burst: 5},
+			allowed: true,
+			want:    creationCounter{Tokens: 4, At: at, Day: today, Daily: 1, Month: month, Monthly: 1},
+		},
+		{
+			name:    "empty bucket",
+			counter: creationCounter{Tokens: 0.5, At: at, Day: today, Daily: 3, Month: month, Monthly: 3},
+			limits:  createLimits{Rate: 60, Burst: 5},
+			allowed: false,
+			want:    creationCounter{Tokens: 0.5, At: at, Day: today, Daily: 3, Month: month, Monthly: 3},
+		},
+		{
+			name:    "bucket refills",
+			counter: creationCounter{Tokens: 0.5, At: at - 2000, Day: today, Daily: 3, Month: month, Monthly: 3},
+			limits:  createLimits{Rate: 60, Burst: 5},
+			allowed: true,
+			want:    creationCounter{Tokens: 1.5, At: at, Day: today, Daily: 4, Month: month, Monthly: 4},
+		},
+		{
+			name:    "bucket refills up to the burst",
+			counter: creationCounter{Tokens: 1, At: at - time.Hour.Milliseconds(), Day: today, Month: month},
+			limits:  createLimits{Rate: 60, Burst: 5},
+			allowed: true,
+			want:    creationCounter{Tokens: 4, At: at, Day: today, Daily: 1, Month: month, Monthly: 1},
+		},
+		{
+			name:    "no rate doesn't touch the bucket",
+			counter: creationCounter{Tokens: 0, At: at, Day: today, Month: month},
+			limits:  createLimits{},
+			allowed: true,
+			want:    creationCounter{Tokens: 0, At: at, Day: today, Daily: 1, Month: month, Monthly: 1},
+		},
+		{
+			name:    "daily quota used up",
+			counter: creationCounter{At: at, Day: today, Daily: 10, Month: month, Monthly: 10},
+			limits:  createLimits{Daily: 10},
+			allowed: false,
+			want:    creationCounter{At: at, Day: today, Daily: 10, Month: month, Monthly: 10},
+		},
+		{
+			name:    "daily quota resets the next day",
+			counter: creationCounter{At: at, Day: "2025-03-14", Daily: 10, Month: month, Monthly: 10},
+			limits:  createLimits{Daily: 10},
+			allowed: true,
+			want:    creationCounter{At: at, Day: today, Daily: 1, Month: month, Monthly: 11},
+		},
+		{
+			name:    "monthly quota used up",
+			counter: creationCounter{At: at, Day: "2025-03-14", Daily: 10, Month: month, Monthly: 20},
+			limits:  createLimits{Daily: 10, Monthly: 20},
+			allowed: false,
+			want:    creationCounter{At: at, Day: today, Daily: 0, Month: month, Monthly: 20},
+		},
+		{
+			name:    "monthly quota resets the next month",
+			counter: creationCounter{At: at, Day: "2025-02-28", Daily: 10, Month: "2025-02", Monthly: 20},
+			limits:  createLimits{Daily: 10, Monthly: 20},
+			allowed: true,
+			want:    creationCounter{At: at, Day: today, Daily: 1, Month: month, Monthly: 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counter := test.counter
+			if allowed := counter.take(test.limits, testNow); allowed != test.allowed {
+				t.Errorf("take() = %v, want %v", allowed, test.allowed)
+			}
+			if counter != test.want {
+				t.Errorf("counter = %+v, want %+v", counter, test.want)
+			}
+		})
+	}
+}
+
+func TestCreationCounterRefund(t *testing.T) {
+	today, month := testNow.Format(time.DateOnly), testNow.Format(monthLayout)
+	counter := creationCounter{Tokens: 2, Day: today, Daily: 3, Month: month, Monthly: 7}
+	counter.refund(testNow)
+	want := creationCounter{Tokens: 2, Day: today, Daily: 2, Month: month, Monthly: 6}
+	if counter != want {
+		t.Errorf("counter = %+v, want %+v", counter, want)
+	}
+
+	// only the quotas of the day and month of the creation are given back.
+	counter.refund(testNow.AddDate(0, 0, 1))
+	want.Monthly--
+	if counter != want {
+		t.Errorf("counter = %+v after refunding the next day, want %+v", counter, want)
+	}
+	counter.refund(testNow.AddDate(0, 1, 0))
+	if counter != want {
+		t.Errorf("counter = %+v after refunding the next month, want %+v", counter, want)
+	}
+}
+
+func TestCreationCounterEncoding(t *testing.T) {
+	counter := creationCounter{Tokens: 1.5, At: testNow.UnixMilli(), Day: "2025-03-15", Daily: 2, Month: "2025-03", Monthly: 9}
+	decoded, err := decodeCreationCounter(encodeCreationCounter(counter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != counter {
+		t.Errorf("decoded = %+v, want %+v", decoded, counter)
+	}
+
+	fresh, err := decodeCreationCounter("")
+	if err != nil || fresh.At != -1 {
+		t.Errorf("decodeCreationCounter(\"\") = %+v, %v, want a new counter", fresh, err)
+	}
+	if _, err := decodeCreationCounter("{"); err == nil {
+		t.Error("decodeCreationCounter(\"{\") succeeded")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		counter creationCounter
+		limits  createLimits
+		want    []rateLimit
+	}{
+		{
+			name:    "no limits",
+			counter: creationCounter{Tokens: 3},
+			limits:  createLimits{},
+			want:    []rateLimit{},
+		},
+		{
+			name:    "rate with tokens left",
+			counter: creationCounter{Tokens: 3},
+			limits:  createLimits{Rate: 60, Burst: 10},
+			want:    []rateLimit{{name: "rate", limit: 10, remaining: 3, reset: 7 * time.Second}},
+		},
+		{
+			name:    "rate without tokens",
+			counter: creationCounter{Tokens: 0.5},
+			limits:  createLimits{Rate: 60, Burst: 10},
+			want: []rateLimit{
+				{name: "rate", limit: 10, remaining: 0, reset: 9500 * time.Millisecond, retry: 500 * time.Millisecond},
+			},
+		},
+		{
+			name:    "quotas",
+			counter: creationCounter{Tokens: 10, Daily: 5, Monthly: 7},
+			limits:  createLimits{Rate: 60, Burst: 10, Daily: 5, Monthly: 100},
+			want: []rateLimit{
+				{name: "rate", limit: 10, remaining: 10},
+				{name: "daily", limit: 5, remaining: 0, reset: 12 * time.Hour, retry: 12 * time.Hour},
+				{name: "monthly", limit: 100, remaining: 93, reset: (16*24 + 12) * time.Hour},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := rateLimits(test.counter, test.limits, testNow)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("rateLimits() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTokenLimits(t *testing.T) {
+	ten, five, thousand := 10, 5, int64(1000)
+	zero := int64(0)
+	tests := []struct {
+		limits string
+		want   tokenLimits
+		ok     bool
+	}{
+		{"", tokenLimits{}, true},
+		{"rate=10", tokenLimits{Rate: &ten}, true},
+		{"rate=10, burst=5,daily=1000,monthly=0", tokenLimits{Rate: &ten, Burst: &five, Daily: &thousand, Monthly: &zero}, true},
+		{"speed=10", tokenLimits{}, false},
+		{"rate=-1", tokenLimits{}, false},
+		{"rate=ten", tokenLimits{}, false},
+		{"rate", tokenLimits{}, false},
+		{"daily=99999999999", tokenLimits{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.limits, func(t *testing.T) {
+			got, err := parseTokenLimits(test.limits)
+			if (err == nil) != test.ok {
+				t.Fatalf("parseTokenLimits(%q) error = %v, want ok %v", test.limits, err, test.ok)
+			}
+			if !test.ok {
+				return
+			}
+			if got.String() != test.want.String() {
+				t.Errorf("parseTokenLimits(%q) = %s, want %s", test.limits, got, test.want)
+			}
+			// what String gives can be parsed back.
+			again, err := parseTokenLimits(got.String())
+			if err != nil || again.String() != got.String() {
+				t.Errorf("parsing %s again = %s, %v", got, again, err)
+			}
+		})
+	}
+}
+
+func TestTokenLimitsOver(t *testing.T) {
+	rate, daily := 0, int64(50)
+	server := createLimits{Rate: 60, Burst: 20, Daily: 0, Monthly: 1000}
+	got := tokenLimits{Rate: &rate, Daily: &daily}.over(server)
+	want := createLimits{Rate: 0, Burst: 20, Daily: 50, Monthly: 1000}
+	if got != want {
+		t.Errorf("over() = %+v, want %+v", got, want)
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	tests := []struct {
+		limits createLimits
+		ok     bool
+	}{
+		{createLimits{Rate: 60, Burst: 20}, true},
+		{createLimits{}, true},
+		{createLimits{Daily: 10, Monthly: 100}, true},
+		{createLimits{Rate: 60}, false},
+		{createLimits{Rate: -1, Burst: 1}, false},
+		{createLimits{Daily: -1}, false},
+	}
+	for _, test := range tests {
+		if err := validateLimits(test.limits); (err == nil) != test.ok {
+			t.Errorf("validateLimits(%+v) = %v, want ok %v", test.limits, err, test.ok)
+		}
+	}
+}
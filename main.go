@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -9,14 +11,14 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/thecsw/pid"
-	"github.com/thecsw/rei"
 )
 
 const (
@@ -27,83 +29,229 @@ const (
 var (
 	// targetUrl is the URL shortener's target URL.
 	targetUrl *string
+	// port is the port the server listens on.
+	port *int
 	// monomi is the database connection.
-	monomi *dangan
+	monomi LinkStore
 
-	// keyToUrlExpire is the time after which a key to url mapping expires.
-	keyToUrlExpire = 24 * time.Hour
+	// cacheTTL is the time after which a key to url mapping expires.
+	cacheTTL *time.Duration
 	// KeytoUrlCleanup is the time after which the key to url cache is cleaned up.
 	KeytoUrlCleanup = 1 * time.Hour
-	// keyToUrl is the key to url cache (faster than a redis network overhead).
-	keyToUrl = cache.New(keyToUrlExpire, KeytoUrlCleanup)
+	// keyToUrl is the key to url cache (faster than a redis network overhead),
+	// every mapping is added with its own expiration, see cacheTTL.
+	keyToUrl = cache.New(cache.NoExpiration, KeytoUrlCleanup)
+
+	// sweepInterval is how often the expired links are deleted.
+	sweepInterval *time.Duration
+	// statsInterval is how often the clicks are saved.
+	statsInterval *time.Duration
+
+	// shutdownTimeout is how long to wait for the requests in flight and the
+	// last clicks to be saved on shutdown.
+	shutdownTimeout *time.Duration
 )
 
 func main() {
-	// Only one monokuma instance can be running at a time
-	defer pid.Start(appName).Stop()
-
 	// Parse the flags.
 	targetUrl = flag.String("url", "https://photos.sandyuraz.com/", "the url with short urls")
-	port := flag.Int("port", 11037, "port at which to open the server")
-	auth := flag.String("auth", "", "auth token (empty for no auth)")
+	configPath = flag.String(configFlag, "", "YAML config file, its settings are overridden by the MONOKUMA_* env vars and the flags (empty for none)")
+	port = flag.Int("port", 11037, "port at which to open the server")
+	auth = flag.String("auth", "", "legacy auth token with every scope, see -token-create (empty for none)")
+	noAuth = flag.Bool("no-auth", false, "serve the API without any token (only for local runs)")
+	corsOrigins = flag.String("cors-origins", "", "comma-separated origins allowed to call the API from browsers (* for any, empty for none)")
+	blocklistPath = flag.String("blocklist", "", "file with the hosts whose urls can't be shortened (empty for none)")
+	cacheTTL = flag.Duration("cache-ttl", 24*time.Hour, "how long the redirects are cached")
+
+	// Storage backend.
+	storeBackend = flag.String("store", storeRedis, "storage backend (redis, memory, or bolt)")
+	storePath = flag.String("store-path", appName+".db", "database file for the bolt store")
 
 	// Redis-basic related things.
 	redisPort = flag.Int("redis-port", 6379, "redis port")
 	redisHost = flag.String("redis-host", "localhost", "redis host")
 	redisDB = flag.Int("redis-db", 0, "redis database")
+	redisNamespace = flag.String("namespace", "", "prefix of all the redis tables, to share redis with other shorteners (empty for none)")
+	migrateNamespace = flag.Bool("migrate-namespace", false, "move the redis tables without a namespace into -namespace and exit")
+	redisURL = flag.String("redis-url", "", "redis:// or rediss:// url (instead of -redis-host, -redis-port, -redis-db, and the credentials)")
 	redisUsername = flag.String("redis-user", appName, "redis user")
+	redisPassFile = flag.String("redis-pass-file", "", "file with the redis password (instead of "+monokumaPasswordEnv+")")
+	redisNoPass = flag.Bool("redis-nopass", false, "the redis user has no password (nopass)")
+	redisSentinels = flag.String("redis-sentinels", "", "comma-separated sentinel addresses (instead of -redis-host and -redis-port)")
+	redisMasterName = flag.String("redis-master", "", "name of the master watched by the sentinels")
+	redisCluster = flag.String("redis-cluster", "", "comma-separated addresses of some cluster nodes (instead of -redis-host and -redis-port)")
 
 	// Redis SSL specific.
 	redisTLS = flag.Bool("redis-tls", false, "use TLS")
-	redisClientCert = flag.String("redis-cert", "client.crt", "client certificate")
+	redisClientCert = flag.String("redis-cert", "client.crt", "client certificate (empty for none)")
 	redisClientKey = flag.String("redis-key", "client.key", "client key")
-	redisCustomCA = flag.String("redis-ca", "ca.der", "CA certificate (in DER)")
+	redisCustomCA = flag.String("redis-ca", "ca.der", "CA certificates (PEM bundle or DER, empty for none)")
+	redisSystemRoots = flag.Bool("redis-system-roots", false, "trust the system's CAs too")
+	redisServerName = flag.String("redis-server-name", "", "name to check the server certificate for (empty for the host)")
+	redisTLSReload = flag.Duration("redis-tls-reload", time.Minute, "how often to reload the certificates if they changed (0 for never)")
+	circuitFailures = flag.Int("redis-breaker-failures", 5, "failed redis commands in a row that stop sending commands for a while")
+	circuitCooldown = flag.Duration("redis-breaker-cooldown", time.Second, "how long to wait before trying redis again (doubles every failure up to a minute)")
 
 	// Key generation tunings.
 	keysize = flag.Int("key-size", 3, "size of the short url keys")
 	alphabet = flag.String("alphabet", "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ", "alphabet used for key gen")
 	maxNumGenTries = flag.Int("gen-tries", 100, "unique key gen number of tries")
+	alwaysAlias = flag.Bool("aliases", false, "create a new key for already shortened urls instead of reusing theirs")
+
+	// Health checks.
+	readyTimeout = flag.Duration("ready-timeout", time.Second, "how long the store has to answer /readyz")
+	readyWhenDegraded = flag.Bool("ready-when-degraded", false, "answer /readyz with 200 while the store is down but the snapshot is served")
+
+	// Degraded mode.
+	storeCheckInterval = flag.Duration("store-check-interval", 5*time.Second, "how often to check if the store is down")
+	snapshotPath = flag.String("snapshot-path", appName+".snapshot.json", "file with the snapshot of the links to serve while the store is down (empty for none)")
+	snapshotInterval = flag.Duration("snapshot-interval", 5*time.Minute, "how often to take the snapshot of the links")
+
+	// Link expiration.
+	sweepInterval = flag.Duration("sweep-interval", time.Minute, "how often to delete expired links")
+
+	// Shutting down.
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for the requests in flight and the last clicks on shutdown")
+
+	// Click analytics.
+	statsInterval = flag.Duration("stats-interval", 5*time.Second, "how often to save the clicks")
+	agentRulesPath = flag.String("agent-rules", "", "user-agent rule file to tell people from bots (empty for the built-in rules)")
+
+	// Limits of the API tokens.
+	createRate = flag.Int("create-rate", 60, "links each API token can create per minute (0 for no limit)")
+	createBurst = flag.Int("create-burst", 20, "links each API token can create at once")
+	createDaily = flag.Int64("create-daily", 0, "links each API token can create per day, UTC (0 for no quota)")
+	createMonthly = flag.Int64("create-monthly", 0, "links each API token can create per month, UTC (0 for no quota)")
+
+	// Limits of the redirects.
+	redirectRate = flag.Int("redirect-rate", 300, "redirects each client IP can get per minute (0 for no limit)")
+	redirectBurst = flag.Int("redirect-burst", 100, "redirects each client IP can get at once")
+	missRate = flag.Int("miss-rate", 10, "unknown keys (404s) each client IP can ask for per minute (0 for no limit)")
+	missBurst = flag.Int("miss-burst", 20, "unknown keys each client IP can ask for at once")
+	redirectTrusted = flag.String("redirect-trusted", "", "comma-separated CIDRs of the clients without redirect limits (empty for none)")
+
+	// API tokens.
+	tokenCreate = flag.String("token-create", "", "create an API token with the name, print it, and exit")
+	tokenCreateLimits = flag.String("token-limits", "", "limits of the created token over the server's, like rate=10,daily=1000 (empty for the server's)")
+	tokenScopes = flag.String("token-scopes", scopeCreate, "comma-separated scopes of the created token (create, update, export, delete, stats, or admin)")
+	tokenRevoke = flag.String("token-revoke", "", "revoke the API token with the name and exit")
+	tokenList = flag.Bool("token-list", false, "list the API tokens and exit")
 
 	// Parse the flags.
 	flag.Parse()
 
+	// Fill in the rest from the config file and the environment.
+	if err := loadConfig(); err != nil {
+		log.Fatalf("loading config: %v", err)
+	}
+
+	// Manage the API tokens, then stop. The server can keep running.
+	if isTokenCommand() {
+		if err := runTokenCommand(); err != nil {
+			log.Fatalf("managing tokens: %v", err)
+		}
+		return
+	}
+
+	// Only one monokuma instance can be running at a time
+	defer pid.Start(appName).Stop()
+
+	// An empty -auth used to turn the auth off, say how to get in now.
+	if !*noAuth && len(*auth) < 1 {
+		log.Printf("the API needs a token, create one with -token-create (or use -no-auth for local runs)")
+	}
+
+	// Load the rules that tell people from bots.
+	rules, err := loadAgentRules(*agentRulesPath)
+	if err != nil {
+		log.Fatalf("loading agent rules: %v", err)
+	}
+	agentRules = rules
+
+	// Load the hosts that can't be shortened.
+	blocked, err := loadBlocklist(*blocklistPath)
+	if err != nil {
+		log.Fatalf("loading blocklist: %v", err)
+	}
+	blockedHosts = blocked
+	corsRules.Store(newCors(*corsOrigins))
+	trustedNets, _ = parseTrustedNets(*redirectTrusted) // checked by loadConfig
+
+	// Load the last snapshot, so the redirects work even if the store is down.
+	if len(*snapshotPath) > 0 {
+		if err := loadSnapshot(*snapshotPath); err != nil {
+			log.Fatalf("loading snapshot: %v", err)
+		}
+	}
+
 	// Set up the database connection.
-	monomi = NewDangan()
+	monomi = NewLinkStore()
 	// Close the database connection when the server is shut down.
 	defer monomi.Close()
 
+	// Move the tables without a namespace into it, then stop.
+	if *migrateNamespace {
+		moved, err := migrateToNamespace(monomi)
+		if err != nil {
+			log.Fatalf("migrating to namespace (moved %d tables before failing): %v", moved, err)
+		}
+		fmt.Printf("moved %d tables into namespace %s\n", moved, *redisNamespace)
+		return
+	}
+
+	// Serve from the snapshot when the store is down, and keep it fresh.
+	go watchStore()
+
+	// Delete the expired links in the background.
+	go sweepExpiredLinks(*sweepInterval)
+
+	// Save the clicks in the background.
+	go writeClicks(*statsInterval)
+
 	// Set up the router.
 	r := chi.NewRouter()
 	// Show the real IP.
 	r.Use(middleware.RealIP)
 	// Set up the middleware.
 	r.Use(middleware.Logger)
+	// Count and time the requests.
+	r.Use(metricsMiddleware)
 	// Disable caching.
 	r.Use(middleware.NoCache)
 	// Remove trailing slashes.
 	r.Use(middleware.RedirectSlashes)
 	// Set up CORS.
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
+	r.Use(corsMiddleware)
 	// Set up the routes.
 
-	// Set up the API admin routes.
+	// Set up the API admin routes, each needs a token with its scope.
 	r.Group(func(r chi.Router) {
-		r.Use(rei.BearerMiddleware(*auth))
-		r.Post("/create", createLink)
-		r.Get("/export", exportLinks)
+		r.Use(authenticate)
+		r.With(requireScope(scopeCreate), limitCreations).Post("/create", createLink)
+		r.With(requireScope(scopeExport)).Get("/export", exportLinks)
+		r.With(requireScope(scopeUpdate)).Put("/{key}", updateLink)
+		r.With(requireScope(scopeUpdate)).Patch("/{key}", updateLink)
+		r.With(requireScope(scopeUpdate)).Post("/{key}/revert", revertLink)
+		r.With(requireScope(scopeExport)).Get("/{key}/history", linkHistory)
+		r.With(requireScope(scopeDelete)).Delete("/{key}", deleteLink)
+		r.With(requireScope(scopeDelete)).Post("/{key}/disable", disableLink)
+		r.With(requireScope(scopeDelete)).Post("/{key}/enable", enableLink)
+
+		// The prometheus metrics.
+		r.With(requireScope(scopeStats)).Get("/metrics", promhttp.Handler().ServeHTTP)
+
+		// The JSON API.
+		r.Route("/api/v1/links", apiLinks)
 	})
 
+	// Health checks for load balancers.
+	r.Get("/healthz", healthz)
+	r.Get("/readyz", readyz)
+
 	// Get the homepage.
 	r.Get("/", hello)
 	// Get a link.
-	r.Get("/{key}", getLink)
+	r.With(limitRedirects).Get("/{key}", getLink)
 
 	// Set up the server's timeouts.
 	srv := &http.Server{
@@ -114,19 +262,44 @@ func main() {
 		WriteTimeout:      10 * time.Second,
 	}
 
+	// Reload the settings that can be on SIGHUP.
+	go reloadOnHangup()
+
 	// Spin the local server up.
 	go func() {
-		log.Fatal(srv.ListenAndServe())
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
 	}()
 	fmt.Printf("server spun up on port %d for base host %s\n", *port, *targetUrl)
 
-	// Wait for a SIGINT.
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt)
-	<-sigint
+	// Wait for a SIGINT or a SIGTERM (from systemd or kubernetes).
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	log.Printf("got %s, shutting down in up to %s", sig, *shutdownTimeout)
+
+	// Stop taking new connections and let the requests in flight finish.
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("draining connections: %v", err)
+	}
+
+	// Save the clicks of those requests too.
+	if err := flushClicks(ctx); err != nil {
+		log.Printf("saving the last clicks: %v", err)
+	}
+
+	// The store and the pid file are closed on the way out.
 	fmt.Println("farewell")
 }
 
+// shortUrl returns the short url for the key.
+func shortUrl(key string) string {
+	return strings.TrimRight(*targetUrl, "/") + "/" + key
+}
+
 // hello is the homepage.
 func hello(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
@@ -136,18 +309,39 @@ func hello(w http.ResponseWriter, r *http.Request) {
 // createLink creates a new link.
 func createLink(w http.ResponseWriter, r *http.Request) {
 	// Create the link.
-	key, code, err := operationCreateLink(r.Body, r.URL.Query().Get("key"))
+	info, code, err := operationCreateLink(r.Body, createOptions{
+		customKey: r.URL.Query().Get("key"),
+		ttl:       r.URL.Query().Get("ttl"),
+		expires:   r.URL.Query().Get("expires"),
+		alias:     r.URL.Query().Get("alias"),
+		createdBy: tokenName(r),
+	})
 
-	// If there were no errors, return the key with the url.
-	if err == nil && code == Success {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(strings.TrimRight(*targetUrl, "/") + "/" + key))
+	// If there was an error, return the error.
+	if err != nil {
+		writeError(w, r, code, err)
 		return
 	}
 
-	// If there was an error, return the error.
-	w.WriteHeader(monokumaHttpCode(code))
-	w.Write([]byte(err.Error()))
+	// Only new links count against the quotas.
+	if !info.Deduped {
+		markCreated(r)
+	}
+
+	// Let the client know if we didn't use their key.
+	if info.CustomKeyIgnored {
+		w.Header().Set(customKeyIgnoredHeader, "true")
+	}
+
+	// Give the whole thing if asked for JSON.
+	if wantsJSON(r) {
+		writeJSON(w, createdStatus(info), createdApiLink(info))
+		return
+	}
+
+	// Otherwise, return the key with the url.
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(shortUrl(info.Key)))
 }
 
 // getLink gets a link.
@@ -158,11 +352,13 @@ func getLink(w http.ResponseWriter, r *http.Request) {
 
 	// If there was an error, return an error.
 	if err != nil {
-		w.WriteHeader(monokumaHttpCode(code))
-		w.Write([]byte(err.Error()))
+		writeError(w, r, code, err)
 		return
 	}
 
+	// Count the click, without waiting for it to be saved.
+	recordClick(r, key)
+
 	// If there was no error, redirect to the link.
 	http.Redirect(w, r, finalUrl, http.StatusFound)
 }
@@ -173,16 +369,112 @@ func exportLinks(w http.ResponseWriter, r *http.Request) {
 
 	// Return an error if found.
 	if err != nil {
-		w.WriteHeader(monokumaHttpCode(code))
-		w.Write([]byte(err.Error()))
+		writeError(w, r, code, err)
 		return
 	}
 
-	// Give the links.
+	// Give the links, as JSON if asked for it.
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, exportedApiLinks(links))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(strings.Join(links, "\n")))
 }
 
+// updateLink points a key to a new link.
+func updateLink(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	code, err := operationUpdateLink(key, r.Body)
+
+	// Return an error if found.
+	if err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+
+	// Give the short url back.
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(shortUrl(key)))
+}
+
+// revertLink points a key back to the link it had before the last update.
+func revertLink(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	code, err := operationRevertLink(key)
+
+	// Return an error if found.
+	if err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+
+	// Give the short url back.
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(shortUrl(key)))
+}
+
+// linkHistory gives the links a key pointed to before.
+func linkHistory(w http.ResponseWriter, r *http.Request) {
+	history, code, err := operationLinkHistory(chi.URLParam(r, "key"))
+
+	// Return an error if found.
+	if err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+
+	// Give the history.
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strings.Join(history, "\n")))
+}
+
+// deleteLink deletes a link.
+func deleteLink(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	code, err := operationDeleteLink(key)
+
+	// Return an error if found.
+	if err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+
+	// It's gone.
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("deleted " + key))
+}
+
+// disableLink disables a link, it will answer with 410 Gone until enabled.
+func disableLink(w http.ResponseWriter, r *http.Request) {
+	setLinkDisabled(w, r, true)
+}
+
+// enableLink enables a previously disabled link.
+func enableLink(w http.ResponseWriter, r *http.Request) {
+	setLinkDisabled(w, r, false)
+}
+
+// setLinkDisabled disables or enables a link.
+func setLinkDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	key := chi.URLParam(r, "key")
+	code, err := operationSetLinkDisabled(key, disabled)
+
+	// Return an error if found.
+	if err != nil {
+		writeError(w, r, code, err)
+		return
+	}
+
+	// Say what we did.
+	w.WriteHeader(http.StatusOK)
+	if disabled {
+		w.Write([]byte("disabled " + key))
+		return
+	}
+	w.Write([]byte("enabled " + key))
+}
+
 // monokumaHttpCode converts a MonokumaStatusCode to an HTTP status code.
 func monokumaHttpCode(code MonokumaStatusCode) int {
 	switch code {
@@ -190,8 +482,20 @@ func monokumaHttpCode(code MonokumaStatusCode) int {
 		return http.StatusFound
 	case LinkNotFound:
 		return http.StatusNotFound
-	case BadKey, BadLink:
+	case LinkGone:
+		return http.StatusGone
+	case BadKey, BadLink, BadExpiry, BadTraffic, KeyTooLong:
 		return http.StatusBadRequest
+	case KeyTaken:
+		return http.StatusConflict
+	case KeyspaceExhausted, StoreUnavailable:
+		return http.StatusServiceUnavailable
+	case Unauthorized:
+		return http.StatusUnauthorized
+	case Forbidden:
+		return http.StatusForbidden
+	case RateLimited:
+		return http.StatusTooManyRequests
 	case Success:
 		return http.StatusOK
 	}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thecsw/rei"
+)
+
+// memoryStore is a LinkStore that keeps everything in the process memory. It
+// is lost on restart, so it's only good for local runs and testing.
+type memoryStore struct {
+	// mu guards the tables.
+	mu sync.RWMutex
+	// tables maps the table name to its fields and values, like redis hashes.
+	tables map[string]map[string]string
+}
+
+// NewMemoryStore creates a new empty in-memory store.
+func NewMemoryStore() *memoryStore {
+	m := &memoryStore{tables: map[string]map[string]string{}}
+	for _, table := range storeTables {
+		m.tables[table] = map[string]string{}
+	}
+	return m
+}
+
+// hget returns the value of the field in the table, must hold mu.
+func (m *memoryStore) hget(table, field string) (string, bool) {
+	val, ok := m.tables[table][field]
+	return val, ok
+}
+
+// hset sets the value of the field in the table, must hold mu.
+func (m *memoryStore) hset(table, field, val string) {
+	if _, ok := m.tables[table]; !ok {
+		m.tables[table] = map[string]string{}
+	}
+	m.tables[table][field] = val
+}
+
+// expired returns true if the key has expired by now, must hold mu.
+func (m *memoryStore) expired(key string, now int64) bool {
+	encoded, _ := m.hget(linkMetaTable, key)
+	meta, err := decodeLinkMeta(encoded)
+	return err == nil && meta.expired(now)
+}
+
+// followable returns true if the key can be followed by now, see
+// linkMeta.followable.
+func (m *memoryStore) followable(key string, now int64) bool {
+	encoded, _ := m.hget(linkMetaTable, key)
+	meta, err := decodeLinkMeta(encoded)
+	return err != nil || meta.followable(now)
+}
+
+// writeLink writes a new link with its metadata to the store. If customKey
+// is provided, it will be used as the key. Otherwise, a new key will be
+// generated. If alias is set, the link gets the new key even if it's already
+// shortened.
+func (m *memoryStore) writeLink(linkb64, customKey string, meta linkMeta, alias bool) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hash := rei.Sha256([]byte(linkb64))
+	now := time.Now().Unix()
+	// we hold the lock, so checking and saving is atomic.
+	claim := func(key string) (string, bool, error) {
+		if !alias {
+			existing, _ := m.hget(linkExistsTable, hash)
+			// disabled keys would answer 410, give a new one instead.
+			for _, owner := range splitKeys(existing) {
+				if m.followable(owner, now) {
+					return owner, true, nil
+				}
+			}
+		}
+		if _, exists := m.hget(keyToLinkTable, key); exists {
+			if !m.expired(key, now) {
+				return "", false, errKeyExists
+			}
+			// sweep the expired key ourselves.
+			m.remove(key)
+		}
+		m.hset(keyToLinkTable, key, linkb64)
+		existing, _ := m.hget(linkExistsTable, hash)
+		m.hset(linkExistsTable, hash, addKey(existing, key))
+		m.hset(linkMetaTable, key, encodeLinkMeta(meta))
+		return key, false, nil
+	}
+	// get a unique key for the link (if customKey is provided, it will be used)
+	key, deduped, err := getUniqueKey(claim, customKey)
+	if err != nil && !errors.Is(err, errKeyExists) {
+		return "", false, fmt.Errorf("getting unique key for link ('%s'): %w", linkb64, err)
+	}
+	return key, deduped, err
+}
+
+// getLink returns the link for the given key.
+func (m *memoryStore) getLink(key string) (string, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	link, found := m.hget(keyToLinkTable, key)
+	return link, found, nil
+}
+
+// exportLinks returns all the links in the store in the format: key,link
+func (m *memoryStore) exportLinks() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]string, 0, len(m.tables[keyToLinkTable]))
+	for key, link := range m.tables[keyToLinkTable] {
+		out = append(out, fmt.Sprintf("%s,%s", key, link))
+	}
+	return out, nil
+}
+
+// exportLinkMeta returns the metadata of all the links in the store by key.
+func (m *memoryStore) exportLinkMeta() (map[string]linkMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return decodeLinkMetas(m.tables[linkMetaTable])
+}
+
+// keyExists returns true if the given key exists in the given table.
+func (m *memoryStore) keyExists(table, key string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, exists := m.hget(table, key)
+	return exists, nil
+}
+
+// isLinkAlreadyShortened checks if the link is already shortened.
+func (m *memoryStore) isLinkAlreadyShortened(linkb64 string) (
+	hash string, keys []string, exists bool, err error,
+) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	hash = rei.Sha256([]byte(linkb64))
+	set, _ := m.hget(linkExistsTable, hash)
+	keys = splitKeys(set)
+	exists = len(keys) > 0
+	return
+}
+
+// updateLink points the key to a new link, moving the key to the new link's
+// hash and saving the old link in the key's history.
+func (m *memoryStore) updateLink(key, linkb64 string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link, found := m.hget(keyToLinkTable, key)
+	if !found {
+		return false, nil
+	}
+	if link == linkb64 {
+		return true, nil
+	}
+	m.hset(keyToLinkTable, key, linkb64)
+	m.removeHashKey(rei.Sha256([]byte(link)), key)
+	newHash := rei.Sha256([]byte(linkb64))
+	existing, _ := m.hget(linkExistsTable, newHash)
+	m.hset(linkExistsTable, newHash, addKey(existing, key))
+	history, _ := m.hget(linkHistoryTable, key)
+	m.hset(linkHistoryTable, key, history+encodeLinkHistoryEntry(linkHistoryEntry{
+		Replaced: time.Now().Unix(),
+		Link:     link,
+	}))
+	return true, nil
+}
+
+// getLinkHistory returns the links the key pointed to before, oldest first.
+func (m *memoryStore) getLinkHistory(key string) ([]linkHistoryEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	encoded, _ := m.hget(linkHistoryTable, key)
+	return decodeLinkHistory(encoded)
+}
+
+// deleteLink removes the key, its link's hash, its metadata, its history, and
+// its stats from the store.
+func (m *memoryStore) deleteLink(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.remove(key), nil
+}
+
+// deleteExpiredLink is deleteLink, but only if the key has expired by now.
+func (m *memoryStore) deleteExpiredLink(key string, now int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.expired(key, now) {
+		return false, nil
+	}
+	return m.remove(key), nil
+}
+
+// remove removes the key and everything about it, must hold mu.
+func (m *memoryStore) remove(key string) bool {
+	link, found := m.hget(keyToLinkTable, key)
+	if !found {
+		return false
+	}
+	delete(m.tables[keyToLinkTable], key)
+	delete(m.tables[linkMetaTable], key)
+	delete(m.tables[linkHistoryTable], key)
+	for _, day := range statsDays(slices.Collect(maps.Keys(m.tables[linkStatsTable(key)]))) {
+		delete(m.tables, linkVisitorsTable(key, day))
+	}
+	delete(m.tables, linkVisitorsTable(key, ""))
+	delete(m.tables, linkStatsTable(key))
+	m.removeHashKey(rei.Sha256([]byte(link)), key)
+	return true
+}
+
+// removeHashKey removes the key from the link hash's set of keys and drops
+// the hash when no keys are left, must hold mu.
+func (m *memoryStore) removeHashKey(hash, key string) {
+	set, _ := m.hget(linkExistsTable, hash)
+	if rest := removeKey(set, key); len(rest) > 0 {
+		m.hset(linkExistsTable, hash, rest)
+		return
+	}
+	delete(m.tables[linkExistsTable], hash)
+}
+
+// expiredKeys returns the keys that have expired by now.
+func (m *memoryStore) expiredKeys(now int64) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := []string{}
+	for key := range m.tables[linkMetaTable] {
+		if m.expired(key, now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// getLinkMeta returns the metadata of the key, empty if there is none.
+func (m *memoryStore) getLinkMeta(key string) (linkMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	encoded, _ := m.hget(linkMetaTable, key)
+	return decodeLinkMeta(encoded)
+}
+
+// setLinkMeta saves the metadata of the key.
+func (m *memoryStore) setLinkMeta(key string, meta linkMeta) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.hget(keyToLinkTable, key); !found {
+		return false, nil
+	}
+	m.hset(linkMetaTable, key, encodeLinkMeta(meta))
+	return true, nil
+}
+
+// addLinkStats adds the counts to the key's stats fields.
+func (m *memoryStore) addLinkStats(key string, counts map[string]int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.hget(keyToLinkTable, key); !found {
+		return nil
+	}
+	table := linkStatsTable(key)
+	for field, count := range counts {
+		old, _ := m.hget(table, field)
+		n, _ := strconv.ParseInt(old, 10, 64) // we only store numbers here
+		m.hset(table, field, strconv.FormatInt(n+count, 10))
+	}
+	return nil
+}
+
+// getLinkStats returns the key's stats fields, empty if there are none.
+func (m *memoryStore) getLinkStats(key string) (map[string]int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return decodeStatsFields(m.tables[linkStatsTable(key)])
+}
+
+// addLinkVisitors adds the hashed visitors of the day to the key's visitors,
+// every visitor is kept, so the counts are exact.
+func (m *memoryStore) addLinkVisitors(key, day string, visitors []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.hget(keyToLinkTable, key); !found {
+		return nil
+	}
+	for _, visitor := range visitors {
+		m.hset(linkVisitorsTable(key, ""), visitor, "")
+		m.hset(linkVisitorsTable(key, day), visitor, "")
+	}
+	return nil
+}
+
+// countLinkVisitors returns the number of the key's visitor days and unique
+// visitors of each of the given days.
+func (m *memoryStore) countLinkVisitors(key string, days []string) (int64, map[string]int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	daily := make(map[string]int64, len(days))
+	for _, day := range days {
+		daily[day] = int64(len(m.tables[linkVisitorsTable(key, day)]))
+	}
+	return int64(len(m.tables[linkVisitorsTable(key, "")])), daily, nil
+}
+
+// visitorSalt returns the salt of the visitors' hashes on the day.
+func (m *memoryStore) visitorSalt(day, fresh string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if salt, found := m.hget(visitorSaltTable, day); found {
+		return salt, nil
+	}
+	oldest := oldestSaltDay(time.Now())
+	for other := range m.tables[visitorSaltTable] {
+		if other < oldest {
+			delete(m.tables[visitorSaltTable], other)
+		}
+	}
+	m.hset(visitorSaltTable, day, fresh)
+	return fresh, nil
+}
+
+// createToken saves the new API token under the name.
+func (m *memoryStore) createToken(name string, token apiToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.hget(apiTokensTable, name); exists {
+		return errTokenExists
+	}
+	m.hset(apiTokensTable, name, encodeApiToken(token))
+	delete(m.tables[apiTokensUsedTable], name)
+	return nil
+}
+
+// getToken returns the API token with the name.
+func (m *memoryStore) getToken(name string) (apiToken, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	encoded, found := m.hget(apiTokensTable, name)
+	if !found {
+		return apiToken{}, false, nil
+	}
+	lastUsed, _ := m.hget(apiTokensUsedTable, name)
+	token, err := decodeApiToken(encoded, lastUsed)
+	return token, err == nil, err
+}
+
+// listTokens returns all the API tokens by name.
+func (m *memoryStore) listTokens() (map[string]apiToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return decodeApiTokens(m.tables[apiTokensTable], m.tables[apiTokensUsedTable])
+}
+
+// deleteToken removes the API token with the name.
+func (m *memoryStore) deleteToken(name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, found := m.hget(apiTokensTable, name)
+	delete(m.tables[apiTokensTable], name)
+	delete(m.tables[apiTokensUsedTable], name)
+	delete(m.tables[creationLimitsTable], name)
+	return found, nil
+}
+
+// touchToken saves that the API token was last used now.
+func (m *memoryStore) touchToken(name string, now int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.hget(apiTokensTable, name); !found {
+		return nil
+	}
+	m.hset(apiTokensUsedTable, name, strconv.FormatInt(now, 10))
+	return nil
+}
+
+// takeCreation counts a link creation of the API token now, if the limits
+// allow it.
+func (m *memoryStore) takeCreation(name string, limits createLimits, now time.Time) (creationCounter, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	encoded, _ := m.hget(creationLimitsTable, name)
+	counter, err := decodeCreationCounter(encoded)
+	if err != nil {
+		return counter, false, err
+	}
+	allowed := counter.take(limits, now)
+	m.hset(creationLimitsTable, name, encodeCreationCounter(counter))
+	return counter, allowed, nil
+}
+
+// refundCreation gives back the quotas of a creation of the API token taken
+// now that didn't create a new link.
+func (m *memoryStore) refundCreation(name string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	encoded, found := m.hget(creationLimitsTable, name)
+	if !found {
+		return nil
+	}
+	counter, err := decodeCreationCounter(encoded)
+	if err != nil {
+		return err
+	}
+	counter.refund(now)
+	m.hset(creationLimitsTable, name, encodeCreationCounter(counter))
+	return nil
+}
+
+// ping always succeeds, the memory is always there.
+func (m *memoryStore) ping(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing, there is nothing to close.
+func (m *memoryStore) Close() {}
@@ -0,0 +1,7 @@
+package main
+
+import "testing"
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(*testing.T) LinkStore { return NewMemoryStore() })
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// metricsNamespace prefixes all of our metrics.
+const metricsNamespace = "monokuma"
+
+var (
+	// httpRequests counts the requests per route, method, and status code.
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method, and status code.",
+	}, []string{"route", "method", "code"})
+
+	// httpRequestDuration observes how long the requests take per route and method.
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "How long the HTTP requests take by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// redirectCacheRequests counts the lookups of the keyToUrl cache by result.
+	redirectCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redirect_cache_requests_total",
+		Help:      "Number of redirect cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	// creationsLimited counts the link creations turned down by the limits of
+	// their API token, by limit.
+	creationsLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "creations_limited_total",
+		Help:      "Number of link creations over the limits of their API token by limit (rate, daily, or monthly).",
+	}, []string{"limit"})
+
+	// redirectsLimited counts the redirects turned down by the limits of
+	// their client, by limit.
+	redirectsLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redirects_limited_total",
+		Help:      "Number of redirects over the limits of their client by limit (rate or misses).",
+	}, []string{"limit"})
+
+	// redisCommandDuration observes how long the redis commands take per
+	// connection and command.
+	redisCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "How long the redis commands take by connection and command.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"conn", "command"})
+
+	// redisCommandErrors counts the failed redis commands per connection and
+	// command. Missing keys are not failures.
+	redisCommandErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_command_errors_total",
+		Help:      "Number of failed redis commands by connection and command.",
+	}, []string{"conn", "command"})
+
+	// redisKeepAliveFailures counts the failed keep-alive pings per connection.
+	redisKeepAliveFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_keepalive_failures_total",
+		Help:      "Number of failed redis keep-alive pings by connection.",
+	}, []string{"conn"})
+
+	// redisCircuitOpen is 1 while the circuit of a connection is open, see
+	// circuitBreaker.
+	redisCircuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_circuit_open",
+		Help:      "Whether the redis circuit of a connection is open (1) or not (0).",
+	}, []string{"conn"})
+
+	// storeDegraded is 1 while the store is down and the redirects are served
+	// from the snapshot, see degraded.
+	storeDegraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "store_degraded",
+		Help:      "Whether the store is down and the redirects are served from the snapshot (1) or not (0).",
+	})
+
+	// snapshotLinks is the number of links in the snapshot.
+	snapshotLinks = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_links",
+		Help:      "Number of links in the snapshot served while the store is down.",
+	})
+
+	// snapshotRedirects counts the redirects served from the snapshot.
+	snapshotRedirects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_redirects_total",
+		Help:      "Number of redirects served from the snapshot because the store failed.",
+	})
+
+	// keyGenerationRetries counts the generated keys that were already taken.
+	keyGenerationRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "key_generation_retries_total",
+		Help:      "Number of generated keys that were already taken and had to be generated again.",
+	})
+
+	// keyspaceExhausted counts the times no unique key could be generated.
+	keyspaceExhausted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "keyspace_exhausted_total",
+		Help:      "Number of times no unique key could be generated after all the tries.",
+	})
+)
+
+// metricsMiddleware counts and times the requests per route.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		// the route is only known after chi routed the request.
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		if len(route) < 1 {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(ww.Status())).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// redisMetricsHook times the commands of a redis connection and counts
+// their failures.
+type redisMetricsHook struct {
+	// conn is the name of the connection, like connPusher.
+	conn string
+}
+
+// DialHook doesn't do anything, dialing is not a command.
+func (h redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook times the command and counts its failure.
+func (h redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		redisCommandDuration.WithLabelValues(h.conn, cmd.Name()).Observe(time.Since(start).Seconds())
+		h.countError(cmd.Name(), err)
+		return err
+	}
+}
+
+// ProcessPipelineHook times the pipeline as a whole, but counts the failures
+// of each command in it.
+func (h redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		redisCommandDuration.WithLabelValues(h.conn, "pipeline").Observe(time.Since(start).Seconds())
+		for _, cmd := range cmds {
+			h.countError(cmd.Name(), cmd.Err())
+		}
+		return err
+	}
+}
+
+// countError counts the failure of the command, if it failed.
+func (h redisMetricsHook) countError(command string, err error) {
+	// missing keys are fine, and so are scripts that weren't loaded yet, as
+	// they're loaded right after.
+	if err != nil && !errors.Is(err, redis.Nil) && !redis.HasErrorPrefix(err, "NOSCRIPT") {
+		redisCommandErrors.WithLabelValues(h.conn, command).Inc()
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// redisNamespace prefixes all the tables in redis, so many shorteners can
+	// share a database, empty for no prefix.
+	redisNamespace *string
+	// migrateNamespace is whether to move the tables without a namespace into
+	// redisNamespace and exit.
+	migrateNamespace *bool
+)
+
+// namespaceRegexp is the regular expression for a namespace, no colons or
+// braces, so it can't be confused with the tables or the hash tag.
+var namespaceRegexp = regexp.MustCompile(`^[-_0-9a-zA-Z]{1,64}$`)
+
+// reservedNamespaces start the names of the tables of each key and day, the
+// tables of such a namespace would be taken for them by migrateToNamespace.
+var reservedNamespaces = []string{
+	strings.TrimSuffix(linkStatsPrefix, ":"), strings.TrimSuffix(linkVisitorsPrefix, ":"), visitorSaltTable,
+}
+
+// validNamespace returns an error if the namespace can't be used.
+func validNamespace(namespace string) error {
+	if !namespaceRegexp.MatchString(namespace) {
+		return fmt.Errorf("namespace %s is invalid, needs to match %s", namespace, namespaceRegexp)
+	}
+	if slices.Contains(reservedNamespaces, namespace) {
+		return fmt.Errorf("namespace %s is reserved, its tables would be mistaken for the %s tables",
+			namespace, namespace)
+	}
+	return nil
+}
+
+// redisPrefix returns what prefixes the tables in the namespace, empty for no
+// namespace. In cluster mode, every namespace shares redisHashTag, so moving
+// the tables into a namespace stays in the same slot.
+func redisPrefix(namespace string, cluster bool) string {
+	prefix := ""
+	if cluster {
+		prefix = redisHashTag
+	}
+	if len(namespace) > 0 {
+		prefix += namespace + ":"
+	}
+	return prefix
+}
+
+// migrateToNamespace moves all the tables without a namespace into
+// redisNamespace and returns how many were moved. The tables that are already
+// in the namespace are never overwritten.
+func migrateToNamespace(store LinkStore) (int, error) {
+	d, ok := store.(*dangan)
+	if !ok {
+		return 0, errors.New("namespaces are only for the redis store")
+	}
+	if len(d.namespace) < 1 {
+		return 0, errors.New("no namespace to move the tables into, give one with -namespace")
+	}
+	ctx := context.Background()
+	from := redisPrefix("", d.cluster)
+
+	// the fixed tables first, then the ones of each key and day.
+	tables := []string{keyToLinkTable, linkExistsTable, linkMetaTable, linkHistoryTable, linkExpiryTable,
+		apiTokensTable, apiTokensUsedTable, creationLimitsTable}
+	for _, prefix := range []string{linkStatsPrefix, linkVisitorsPrefix, visitorSaltTable + ":"} {
+		found, err := d.scanKeys(ctx, from+prefix+"*")
+		if err != nil {
+			return 0, fmt.Errorf("finding %s tables: %w", prefix, err)
+		}
+		for _, name := range found {
+			tables = append(tables, name[len(from):])
+		}
+	}
+
+	moved := 0
+	for _, table := range tables {
+		renamed, err := d.rdb.RenameNX(ctx, from+table, d.table(table)).Result()
+		// not every table is there, like the history if nothing was updated.
+		if redis.HasErrorPrefix(err, "no such key") {
+			continue
+		}
+		if err != nil {
+			return moved, fmt.Errorf("moving %s: %w", table, err)
+		}
+		if !renamed {
+			return moved, fmt.Errorf("moving %s: %s is already in the namespace", table, d.table(table))
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// scanKeys returns the names of all the keys matching the pattern, on every
+// master in cluster mode.
+func (d *dangan) scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var mu sync.Mutex
+	keys := []string{}
+	scan := func(ctx context.Context, client *redis.Client) error {
+		iter := client.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			keys = append(keys, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+	var err error
+	if cluster, ok := d.rdb.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, scan)
+	} else {
+		err = scan(ctx, d.rdb.(*redis.Client))
+	}
+	return keys, err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/thecsw/rei"
+)
+
+func TestValidNamespace(t *testing.T) {
+	tests := map[string]bool{
+		"photos":                true,
+		"go-example_com":        true,
+		strings.Repeat("n", 64): true,
+		strings.Repeat("n", 65): false,
+		"":                      false,
+		"photos:old":            false,
+		"{monokuma}":            false,
+		"linkstats":             false,
+		"linkvisitors":          false,
+		"visitorsalt":           false,
+		"linkstats2":            true,
+		"keytob64":              true,
+	}
+	for namespace, ok := range tests {
+		if err := validNamespace(namespace); (err == nil) != ok {
+			t.Errorf("validNamespace(%q) = %v, want ok %v", namespace, err, ok)
+		}
+	}
+}
+
+func TestMigrateToNamespace(t *testing.T) {
+	server := miniredis.RunT(t)
+	old, other := testDanganOn(server, "", false), testDanganOn(server, "other", false)
+	for _, d := range []*dangan{old, other} {
+		if _, _, err := d.writeLink(rei.Btao([]byte("https://example.com/")), "abc", linkMeta{}, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.addLinkStats("abc", map[string]int64{"clicks": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	otherKeys := slices.DeleteFunc(server.Keys(), func(key string) bool { return !strings.HasPrefix(key, "other:") })
+
+	photos := testDanganOn(server, "photos", false)
+	moved, err := migrateToNamespace(photos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 4 {
+		t.Errorf("moved %d tables, want 4", moved)
+	}
+	for _, key := range server.Keys() {
+		if !strings.HasPrefix(key, "photos:") && !strings.HasPrefix(key, "other:") {
+			t.Errorf("table %s wasn't moved", key)
+		}
+	}
+	if link, found, err := photos.getLink("abc"); !found || err != nil || link != rei.Btao([]byte("https://example.com/")) {
+		t.Errorf("link of abc in the namespace = %q, %v, %v", link, found, err)
+	}
+	if stats, err := photos.getLinkStats("abc"); err != nil || stats["clicks"] != 1 {
+		t.Errorf("stats of abc in the namespace = %v, %v", stats, err)
+	}
+	// another namespace is left alone.
+	remaining := slices.DeleteFunc(server.Keys(), func(key string) bool { return !strings.HasPrefix(key, "other:") })
+	if !slices.Equal(remaining, otherKeys) {
+		t.Errorf("tables of the other namespace = %v, want %v", remaining, otherKeys)
+	}
+
+	// a second run finds nothing left to move.
+	if moved, err := migrateToNamespace(photos); moved != 0 || err != nil {
+		t.Errorf("migrating again = %d, %v, want nothing moved", moved, err)
+	}
+}
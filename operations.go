@@ -1,12 +1,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"maps"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/patrickmn/go-cache"
 	"github.com/thecsw/rei"
 )
 
@@ -18,10 +23,32 @@ const (
 	LinkFound MonokumaStatusCode = iota
 	// LinkNotFound indicates that the link was not found.
 	LinkNotFound
+	// LinkGone indicates that the link exists but can't be followed anymore.
+	LinkGone
 	// BadKey indicates that the key was bad.
 	BadKey
 	// BadLink indicates that the link was bad.
 	BadLink
+	// BadExpiry indicates that the link's expiration was bad.
+	BadExpiry
+	// BadTraffic indicates that the class of traffic was bad.
+	BadTraffic
+	// KeyTaken indicates that the custom key is already used by another link.
+	KeyTaken
+	// KeyTooLong indicates that the custom key is too long.
+	KeyTooLong
+	// KeyspaceExhausted indicates that no unique key could be generated.
+	KeyspaceExhausted
+	// StoreUnavailable indicates that the store is down and only redirects
+	// are served, see degraded.
+	StoreUnavailable
+	// Unauthorized indicates that the request has no valid API token.
+	Unauthorized
+	// Forbidden indicates that the API token doesn't have the scope.
+	Forbidden
+	// RateLimited indicates that the API token or the client is over its
+	// limits, see limitCreations and limitRedirects.
+	RateLimited
 	// LinkRetrievalError indicates that the link retrieval failed.
 	LinkRetrievalError
 	// Uncategorized indicates that the error was uncategorized.
@@ -30,14 +57,60 @@ const (
 	Success
 )
 
+// monokumaStatusNames are the names of the status codes, for humans.
+var monokumaStatusNames = map[MonokumaStatusCode]string{
+	LinkFound:          "LinkFound",
+	LinkNotFound:       "LinkNotFound",
+	LinkGone:           "LinkGone",
+	BadKey:             "BadKey",
+	BadLink:            "BadLink",
+	BadExpiry:          "BadExpiry",
+	BadTraffic:         "BadTraffic",
+	KeyTaken:           "KeyTaken",
+	KeyTooLong:         "KeyTooLong",
+	KeyspaceExhausted:  "KeyspaceExhausted",
+	StoreUnavailable:   "StoreUnavailable",
+	Unauthorized:       "Unauthorized",
+	Forbidden:          "Forbidden",
+	RateLimited:        "RateLimited",
+	LinkRetrievalError: "LinkRetrievalError",
+	Uncategorized:      "Uncategorized",
+	Success:            "Success",
+}
+
+// String returns the name of the status code.
+func (code MonokumaStatusCode) String() string {
+	if name, ok := monokumaStatusNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("MonokumaStatusCode(%d)", uint8(code))
+}
+
+// linkInfo is everything we know about a short link.
+type linkInfo struct {
+	// Key is the key of the short link.
+	Key string
+	// Link is the link the key points to.
+	Link string
+	// Meta is the bookkeeping of the link.
+	Meta linkMeta
+	// Deduped is true if the link was already shortened under the key.
+	Deduped bool
+	// CustomKeyIgnored is true if a custom key was asked for, but the link
+	// was already shortened under another key.
+	CustomKeyIgnored bool
+	// Aliases are the other keys that shorten the same link.
+	Aliases []string
+}
+
 // keyRegexpPattern is the regular expression pattern for a key.
 const keyRegexpPattern = `[-0-9a-zA-Z]{3,37}`
 
 // keyRegexp is the regular expression for a key.
 var keyRegexp = regexp.MustCompile(`^` + keyRegexpPattern + `$`)
 
-// operationCreateLink takes a link and returns a key.
-func operationCreateLink(linkReader io.Reader, customKey string) (string, MonokumaStatusCode, error) {
+// readLink reads and validates the link.
+func readLink(linkReader io.Reader) (string, MonokumaStatusCode, error) {
 	// Read the link.
 	linkBytes, err := io.ReadAll(linkReader)
 	if err != nil {
@@ -62,14 +135,166 @@ func operationCreateLink(linkReader io.Reader, customKey string) (string, Monoku
 		return "", BadLink, fmt.Errorf("link is invalid, it needs to match regex: %s", URLRegexpPattern)
 	}
 
+	// If the link's host is blocked, return an error.
+	if host, blocked := isBlocked(link); blocked {
+		return "", BadLink, fmt.Errorf("links to %s can't be shortened", host)
+	}
+
+	return link, Success, nil
+}
+
+// createOptions are the optional parts of a link creation request.
+type createOptions struct {
+	// customKey is the key to use instead of a generated one.
+	customKey string
+	// ttl is how long the link should live, like "72h". Empty for forever.
+	ttl string
+	// expires is when the link should expire, in RFC 3339. Empty for never.
+	expires string
+	// alias is "true" to always create a new key, even if the link is already
+	// shortened, or "false" to reuse the existing key. Empty for alwaysAlias.
+	alias string
+	// createdBy is the name of the API token creating the link, empty for none.
+	createdBy string
+}
+
+// parseAlias returns whether to create an alias for an already shortened link.
+func (opts createOptions) parseAlias() (bool, error) {
+	if len(opts.alias) < 1 {
+		return setting(alwaysAlias), nil
+	}
+	alias, err := strconv.ParseBool(opts.alias)
+	if err != nil {
+		return false, fmt.Errorf("alias %s is invalid, needs to be true or false", opts.alias)
+	}
+	return alias, nil
+}
+
+// parseExpiry returns the unix time when the link should expire, 0 for never.
+func (opts createOptions) parseExpiry(now time.Time) (int64, error) {
+	switch {
+	case len(opts.ttl) > 0 && len(opts.expires) > 0:
+		return 0, fmt.Errorf("only one of ttl and expires can be given")
+	case len(opts.ttl) > 0:
+		ttl, err := time.ParseDuration(opts.ttl)
+		if err != nil {
+			return 0, fmt.Errorf("ttl %s is invalid, needs to be a duration like 72h: %v", opts.ttl, err)
+		}
+		if ttl <= 0 {
+			return 0, fmt.Errorf("ttl %s is invalid, needs to be positive", opts.ttl)
+		}
+		return now.Add(ttl).Unix(), nil
+	case len(opts.expires) > 0:
+		expires, err := time.Parse(time.RFC3339, opts.expires)
+		if err != nil {
+			return 0, fmt.Errorf("expires %s is invalid, needs to be RFC 3339: %v", opts.expires, err)
+		}
+		if !expires.After(now) {
+			return 0, fmt.Errorf("expires %s is invalid, needs to be in the future", opts.expires)
+		}
+		return expires.Unix(), nil
+	}
+	return 0, nil
+}
+
+// operationCreateLink takes a link and returns its short link.
+func operationCreateLink(linkReader io.Reader, opts createOptions) (linkInfo, MonokumaStatusCode, error) {
+	// Nothing can be written while the store is down.
+	if code, err := storeWritable(); err != nil {
+		return linkInfo{}, code, err
+	}
+
+	// Read the link.
+	link, code, err := readLink(linkReader)
+	if err != nil {
+		return linkInfo{}, code, err
+	}
+
+	// See if the link should expire.
+	now := time.Now()
+	expires, err := opts.parseExpiry(now)
+	if err != nil {
+		return linkInfo{}, BadExpiry, err
+	}
+
+	// See if the link should get another key if it's already shortened.
+	alias, err := opts.parseAlias()
+	if err != nil {
+		return linkInfo{}, BadKey, err
+	}
+
 	// Try to write the link.
-	key, err := monomi.writeLink(rei.Btao([]byte(link)), customKey)
+	meta := linkMeta{Created: now.Unix(), Expires: expires, CreatedBy: opts.createdBy}
+	key, deduped, err := monomi.writeLink(rei.Btao([]byte(link)), opts.customKey, meta, alias)
 	if err != nil {
-		return "", Uncategorized, fmt.Errorf("shortening the link: %v", err)
+		return linkInfo{}, writeLinkCode(err), fmt.Errorf("shortening the link: %v", err)
 	}
 
-	// Return the key.
-	return key, Success, nil
+	// The link was already there, so it has its own metadata.
+	if deduped {
+		if meta, err = monomi.getLinkMeta(key); err != nil {
+			return linkInfo{}, Uncategorized, fmt.Errorf("critical failure during metadata retrieval: %v", err)
+		}
+	}
+
+	// Return the short link.
+	return linkInfo{
+		Key:              key,
+		Link:             link,
+		Meta:             meta,
+		Deduped:          deduped,
+		CustomKeyIgnored: len(opts.customKey) > 0 && key != opts.customKey,
+	}, Success, nil
+}
+
+// writeLinkCode returns the status code for the error of writeLink.
+func writeLinkCode(err error) MonokumaStatusCode {
+	switch {
+	case errors.Is(err, errKeyExists):
+		return KeyTaken
+	case errors.Is(err, errKeyTooLong):
+		return KeyTooLong
+	case errors.Is(err, errKeyInvalid):
+		return BadKey
+	case errors.Is(err, errKeyspaceExhausted):
+		return KeyspaceExhausted
+	}
+	return Uncategorized
+}
+
+// operationGetLinkInfo returns everything we know about the key, even if
+// it's disabled or expired.
+func operationGetLinkInfo(key string) (linkInfo, MonokumaStatusCode, error) {
+	// Check the key against the regular expression.
+	if !keyRegexp.MatchString(key) {
+		return linkInfo{}, BadKey, fmt.Errorf("key %s is invalid, needs to match %s", key, keyRegexpPattern)
+	}
+
+	// Get the link.
+	linkb64, found, err := monomi.getLink(key)
+	if err != nil {
+		return linkInfo{}, LinkRetrievalError, fmt.Errorf("critical failure during retrieval: %v", err)
+	}
+
+	// If the key is not found, return an error.
+	if !found {
+		return linkInfo{}, LinkNotFound, fmt.Errorf("short url for %s not found", key)
+	}
+
+	// Get the metadata.
+	meta, err := monomi.getLinkMeta(key)
+	if err != nil {
+		return linkInfo{}, LinkRetrievalError, fmt.Errorf("critical failure during metadata retrieval: %v", err)
+	}
+
+	// Get the other keys of the link.
+	_, keys, _, err := monomi.isLinkAlreadyShortened(linkb64)
+	if err != nil {
+		return linkInfo{}, LinkRetrievalError, fmt.Errorf("critical failure during aliases retrieval: %v", err)
+	}
+	aliases := slices.DeleteFunc(keys, func(k string) bool { return k == key })
+
+	return linkInfo{Key: key, Link: string(rei.AtobMust(linkb64)), Meta: meta, Aliases: aliases}, LinkFound, nil
 }
 
 // operationKeyToLink takes a key and returns the final link.
@@ -81,13 +306,15 @@ func operationKeyToLink(key string) (string, MonokumaStatusCode, error) {
 
 	// Check the cache for the key.
 	if finalUrl, found := keyToUrl.Get(key); found {
+		redirectCacheRequests.WithLabelValues("hit").Inc()
 		return finalUrl.(string), LinkFound, nil
 	}
+	redirectCacheRequests.WithLabelValues("miss").Inc()
 
 	// If the key is empty, return an error.
 	linkb64, found, err := monomi.getLink(key)
 	if err != nil {
-		return "", LinkRetrievalError, fmt.Errorf("critical failure during retrieval: %v", err)
+		return linkFromSnapshot(key, fmt.Errorf("critical failure during retrieval: %v", err))
 	}
 
 	// If the key is not found, return an error.
@@ -95,16 +322,52 @@ func operationKeyToLink(key string) (string, MonokumaStatusCode, error) {
 		return "", LinkNotFound, fmt.Errorf("short url for %s not found", key)
 	}
 
+	// Disabled links are kept around but not followed.
+	meta, err := monomi.getLinkMeta(key)
+	if err != nil {
+		return linkFromSnapshot(key, fmt.Errorf("critical failure during metadata retrieval: %v", err))
+	}
+	if meta.Disabled != 0 {
+		return "", LinkGone, fmt.Errorf("short url for %s has been disabled", key)
+	}
+
+	// Expired links are gone until they're swept.
+	now := time.Now()
+	if meta.expired(now.Unix()) {
+		return "", LinkGone, fmt.Errorf("short url for %s has expired", key)
+	}
+
 	// Decode the link.
 	finalUrl := string(rei.AtobMust(linkb64))
 
+	// Don't keep the mapping in the cache after the link expires.
+	cacheFor := setting(cacheTTL)
+	if meta.Expires != 0 && time.Unix(meta.Expires, 0).Sub(now) < cacheFor {
+		cacheFor = time.Unix(meta.Expires, 0).Sub(now)
+	}
+
 	// Add the mapping to the cache.
-	keyToUrl.Add(key, finalUrl, cache.DefaultExpiration)
+	keyToUrl.Add(key, finalUrl, cacheFor)
 
 	// Return the final link after it's been cached.
 	return finalUrl, LinkFound, nil
 }
 
+// linkFromSnapshot returns the link of the key from the snapshot when the
+// store failed with err, or err if the snapshot doesn't have it either. While
+// the store is down, that's StoreUnavailable, the client can try again later.
+func linkFromSnapshot(key string, err error) (string, MonokumaStatusCode, error) {
+	if finalUrl, found := snapshot.get(key, time.Now().Unix()); found {
+		snapshotRedirects.Inc()
+		return finalUrl, LinkFound, nil
+	}
+	if degraded.Load() {
+		return "", StoreUnavailable, fmt.Errorf("%w, and short url for %s isn't in the snapshot: %v",
+			errStoreDown, key, err)
+	}
+	return "", LinkRetrievalError, err
+}
+
 // operationExportLinks exports all links.
 func operationExportLinks() ([]string, MonokumaStatusCode, error) {
 	// Get the links.
@@ -118,3 +381,241 @@ func operationExportLinks() ([]string, MonokumaStatusCode, error) {
 	// Got the links.
 	return links, Success, nil
 }
+
+// operationDeleteLink deletes the key, so it doesn't redirect anywhere anymore.
+func operationDeleteLink(key string) (MonokumaStatusCode, error) {
+	// Check the key against the regular expression.
+	if !keyRegexp.MatchString(key) {
+		return BadKey, fmt.Errorf("key %s is invalid, needs to match %s", key, keyRegexpPattern)
+	}
+
+	// Nothing can be written while the store is down.
+	if code, err := storeWritable(); err != nil {
+		return code, err
+	}
+
+	// Delete the key.
+	found, err := monomi.deleteLink(key)
+	if err != nil {
+		return Uncategorized, fmt.Errorf("critical failure during deletion: %v", err)
+	}
+
+	// If the key is not found, return an error.
+	if !found {
+		return LinkNotFound, fmt.Errorf("short url for %s not found", key)
+	}
+
+	// Don't serve it from the cache or the snapshot either.
+	keyToUrl.Delete(key)
+	snapshot.forget(key)
+	return Success, nil
+}
+
+// operationSetLinkDisabled disables or enables the key. Disabled keys are kept
+// but answer with LinkGone.
+func operationSetLinkDisabled(key string, disabled bool) (MonokumaStatusCode, error) {
+	// Check the key against the regular expression.
+	if !keyRegexp.MatchString(key) {
+		return BadKey, fmt.Errorf("key %s is invalid, needs to match %s", key, keyRegexpPattern)
+	}
+
+	// Nothing can be written while the store is down.
+	if code, err := storeWritable(); err != nil {
+		return code, err
+	}
+
+	// Get the current metadata to update it.
+	meta, err := monomi.getLinkMeta(key)
+	if err != nil {
+		return Uncategorized, fmt.Errorf("critical failure during metadata retrieval: %v", err)
+	}
+
+	// Mark when it was disabled, or clear it.
+	meta.Disabled = 0
+	if disabled {
+		meta.Disabled = time.Now().Unix()
+	}
+
+	// Save the metadata.
+	found, err := monomi.setLinkMeta(key, meta)
+	if err != nil {
+		return Uncategorized, fmt.Errorf("critical failure during metadata update: %v", err)
+	}
+
+	// If the key is not found, return an error.
+	if !found {
+		return LinkNotFound, fmt.Errorf("short url for %s not found", key)
+	}
+
+	// Don't serve it from the cache or the snapshot either.
+	keyToUrl.Delete(key)
+	snapshot.forget(key)
+	return Success, nil
+}
+
+// operationUpdateLink points the key to a new link.
+func operationUpdateLink(key string, linkReader io.Reader) (MonokumaStatusCode, error) {
+	// Check the key against the regular expression.
+	if !keyRegexp.MatchString(key) {
+		return BadKey, fmt.Errorf("key %s is invalid, needs to match %s", key, keyRegexpPattern)
+	}
+
+	// Nothing can be written while the store is down.
+	if code, err := storeWritable(); err != nil {
+		return code, err
+	}
+
+	// Read the new link.
+	link, code, err := readLink(linkReader)
+	if err != nil {
+		return code, err
+	}
+
+	return pointLinkTo(key, rei.Btao([]byte(link)))
+}
+
+// operationRevertLink points the key back to the link it had before the last update.
+func operationRevertLink(key string) (MonokumaStatusCode, error) {
+	// Check the key against the regular expression.
+	if !keyRegexp.MatchString(key) {
+		return BadKey, fmt.Errorf("key %s is invalid, needs to match %s", key, keyRegexpPattern)
+	}
+
+	// Nothing can be written while the store is down.
+	if code, err := storeWritable(); err != nil {
+		return code, err
+	}
+
+	// Find the previous link.
+	history, err := monomi.getLinkHistory(key)
+	if err != nil {
+		return Uncategorized, fmt.Errorf("critical failure during history retrieval: %v", err)
+	}
+	if len(history) < 1 {
+		return BadKey, fmt.Errorf("short url for %s has no previous links", key)
+	}
+
+	// The current link goes into the history, so reverting can be undone too.
+	return pointLinkTo(key, history[len(history)-1].Link)
+}
+
+// pointLinkTo points the key to the new base64 link and drops the cached one.
+func pointLinkTo(key, linkb64 string) (MonokumaStatusCode, error) {
+	found, err := monomi.updateLink(key, linkb64)
+	if err != nil {
+		return Uncategorized, fmt.Errorf("critical failure during update: %v", err)
+	}
+
+	// If the key is not found, return an error.
+	if !found {
+		return LinkNotFound, fmt.Errorf("short url for %s not found", key)
+	}
+
+	// Don't serve the old link from the cache or the snapshot.
+	keyToUrl.Delete(key)
+	snapshot.forget(key)
+	return Success, nil
+}
+
+// operationGetLinkHistory returns the links the key pointed to before, oldest first.
+func operationGetLinkHistory(key string) ([]linkHistoryEntry, MonokumaStatusCode, error) {
+	// Check the key against the regular expression.
+	if !keyRegexp.MatchString(key) {
+		return nil, BadKey, fmt.Errorf("key %s is invalid, needs to match %s", key, keyRegexpPattern)
+	}
+
+	// Get the history.
+	history, err := monomi.getLinkHistory(key)
+	if err != nil {
+		return nil, Uncategorized, fmt.Errorf("critical failure during history retrieval: %v", err)
+	}
+	return history, Success, nil
+}
+
+// operationLinkHistory returns the links the key pointed to before, oldest
+// first, in the format: replaced,link
+func operationLinkHistory(key string) ([]string, MonokumaStatusCode, error) {
+	// Get the history.
+	history, code, err := operationGetLinkHistory(key)
+	if err != nil {
+		return nil, code, err
+	}
+
+	// Make it readable.
+	out := make([]string, 0, len(history))
+	for _, entry := range history {
+		out = append(out, fmt.Sprintf("%s,%s",
+			time.Unix(entry.Replaced, 0).UTC().Format(time.RFC3339), rei.AtobMust(entry.Link)))
+	}
+	return out, Success, nil
+}
+
+// operationGetLinkStats returns the clicks of the key from the class of
+// traffic, human if empty, or from all of them if it's trafficAll.
+func operationGetLinkStats(key, traffic string) (linkStats, MonokumaStatusCode, error) {
+	// Check the key against the regular expression.
+	if !keyRegexp.MatchString(key) {
+		return linkStats{}, BadKey, fmt.Errorf("key %s is invalid, needs to match %s", key, keyRegexpPattern)
+	}
+
+	// See which traffic to count.
+	classes := []string{trafficHuman}
+	switch {
+	case traffic == trafficAll:
+		classes = trafficClasses
+	case len(traffic) > 0 && !slices.Contains(trafficClasses, traffic):
+		return linkStats{}, BadTraffic, fmt.Errorf("traffic %s is invalid, needs to be one of %s, %s",
+			traffic, strings.Join(trafficClasses, ", "), trafficAll)
+	case len(traffic) > 0:
+		classes = []string{traffic}
+	}
+
+	// Only existing keys have stats.
+	found, err := monomi.keyExists(keyToLinkTable, key)
+	if err != nil {
+		return linkStats{}, LinkRetrievalError, fmt.Errorf("critical failure during retrieval: %v", err)
+	}
+	if !found {
+		return linkStats{}, LinkNotFound, fmt.Errorf("short url for %s not found", key)
+	}
+
+	// Get the stats.
+	counts, err := monomi.getLinkStats(key)
+	if err != nil {
+		return linkStats{}, Uncategorized, fmt.Errorf("critical failure during stats retrieval: %v", err)
+	}
+	stats := decodeLinkStats(counts, classes)
+
+	// Only people are visitors.
+	if !slices.Contains(classes, trafficHuman) {
+		return stats, Success, nil
+	}
+
+	// Count the visitors on the days with clicks.
+	days := statsDays(slices.Collect(maps.Keys(counts)))
+	stats.VisitorDays, stats.DailyVisitors, err = monomi.countLinkVisitors(key, days)
+	if err != nil {
+		return linkStats{}, Uncategorized, fmt.Errorf("critical failure during visitors retrieval: %v", err)
+	}
+	return stats, Success, nil
+}
+
+// sweepExpiredLinks deletes the expired links every interval, forever.
+func sweepExpiredLinks(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now().Unix()
+		keys, err := monomi.expiredKeys(now)
+		if err != nil {
+			log.Printf("sweeping expired links: %v", err)
+			continue
+		}
+		for _, key := range keys {
+			if _, err := monomi.deleteExpiredLink(key, now); err != nil {
+				log.Printf("sweeping expired link %s: %v", key, err)
+				continue
+			}
+			keyToUrl.Delete(key)
+			snapshot.forget(key)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// clientLimitsExpire is how long the limits of a client are kept after its
+	// last redirect, by then its buckets are full again anyway.
+	clientLimitsExpire = 10 * time.Minute
+	// clientLimitsCleanup is how often the expired limits are dropped.
+	clientLimitsCleanup = time.Minute
+)
+
+var (
+	// redirectRate is how many redirects a client can get per minute, 0 for
+	// no limit.
+	redirectRate *int
+	// redirectBurst is how many redirects a client can get at once.
+	redirectBurst *int
+	// missRate is how many unknown keys (404s) a client can ask for per
+	// minute, 0 for no limit.
+	missRate *int
+	// missBurst is how many unknown keys a client can ask for at once.
+	missBurst *int
+	// redirectTrusted are the comma-separated CIDRs that have no limits.
+	redirectTrusted *string
+
+	// trustedNets are the networks of redirectTrusted, replaced on reload.
+	trustedNets []netip.Prefix
+
+	// clientLimits maps the clients, see clientKey, to their *redirectLimits.
+	clientLimits = cache.New(clientLimitsExpire, clientLimitsCleanup)
+)
+
+// tokenBucket holds up to a burst of tokens and refills a rate of them per
+// minute.
+type tokenBucket struct {
+	// tokens are the tokens left.
+	tokens float64
+	// at is when the bucket was last refilled, zero if never.
+	at time.Time
+}
+
+// refill adds the tokens since the last time, a new bucket is full.
+func (b *tokenBucket) refill(rate, burst int, now time.Time) {
+	if b.at.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.at).Minutes() * float64(rate)
+	}
+	b.tokens = min(b.tokens, float64(burst))
+	b.at = now
+}
+
+// wait returns how long until the bucket has a token, 0 if it has one now.
+func (b *tokenBucket) wait(rate int) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(time.Minute) / float64(rate))
+}
+
+// redirectLimits are the buckets of a client.
+type redirectLimits struct {
+	// mu guards the buckets.
+	mu sync.Mutex
+	// all is taken from by every redirect, see redirectRate.
+	all tokenBucket
+	// misses is taken from by the unknown keys, see missRate.
+	misses tokenBucket
+}
+
+// parseTrustedNets parses the comma-separated CIDRs (or addresses), empty
+// for none.
+func parseTrustedNets(nets string) ([]netip.Prefix, error) {
+	out := []netip.Prefix{}
+	if len(nets) < 1 {
+		return out, nil
+	}
+	for _, part := range strings.Split(nets, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return nil, fmt.Errorf("trusted address %s is invalid: %w", part, err)
+			}
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, fmt.Errorf("trusted network %s is invalid: %w", part, err)
+		}
+		out = append(out, prefix.Masked())
+	}
+	return out, nil
+}
+
+// isTrusted returns true if the address is in one of the trusted networks.
+func isTrusted(addr netip.Addr) bool {
+	for _, prefix := range setting(&trustedNets) {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientKey returns who the limits are counted for: the IPv4 address, or the
+// /64 network of the IPv6 one, as that's what a single client usually gets.
+func clientKey(addr netip.Addr) string {
+	if addr.Is4() {
+		return addr.String()
+	}
+	return netip.PrefixFrom(addr, 64).Masked().String()
+}
+
+// limitsOf returns the limits of the client, new ones if it has none yet, and
+// keeps them for another clientLimitsExpire.
+func limitsOf(key string) *redirectLimits {
+	if found, ok := clientLimits.Get(key); ok {
+		clientLimits.Set(key, found, cache.DefaultExpiration)
+		return found.(*redirectLimits)
+	}
+	limits := &redirectLimits{}
+	if err := clientLimits.Add(key, limits, cache.DefaultExpiration); err != nil {
+		// someone else added them first.
+		if found, ok := clientLimits.Get(key); ok {
+			return found.(*redirectLimits)
+		}
+	}
+	return limits
+}
+
+// limitRedirects answers 429 Too Many Requests if the client, by its address
+// from middleware.RealIP, got too many redirects, or asked for too many keys
+// that don't exist, which is what guessing the keys looks like. The trusted
+// networks have no limits.
+func limitRedirects(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settingsMu.RLock()
+		rate, burst, misses, missesBurst := *redirectRate, *redirectBurst, *missRate, *missBurst
+		settingsMu.RUnlock()
+		addr, err := netip.ParseAddr(remoteIP(r))
+		if err != nil || (rate < 1 && misses < 1) || isTrusted(addr.Unmap()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		addr = addr.Unmap()
+		limits := limitsOf(clientKey(addr))
+
+		now := time.Now()
+		limit, wait := "", time.Duration(0)
+		limits.mu.Lock()
+		if rate > 0 {
+			limits.all.refill(rate, burst, now)
+			if d := limits.all.wait(rate); d > wait {
+				limit, wait = "rate", d
+			}
+		}
+		if misses > 0 {
+			limits.misses.refill(misses, missesBurst, now)
+			if d := limits.misses.wait(misses); d > wait {
+				limit, wait = "misses", d
+			}
+		}
+		if wait == 0 && rate > 0 {
+			limits.all.tokens--
+		}
+		limits.mu.Unlock()
+
+		if wait > 0 {
+			redirectsLimited.WithLabelValues(limit).Inc()
+			w.Header().Set("Retry-After", seconds(wait))
+			writeError(w, r, RateLimited, fmt.Errorf("too many requests from %s, try again in %ss",
+				addr, seconds(wait)))
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		// only now we know whether the key was there.
+		if misses > 0 && ww.Status() == http.StatusNotFound {
+			limits.mu.Lock()
+			limits.misses.tokens--
+			limits.mu.Unlock()
+		}
+	})
+}
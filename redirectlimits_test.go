@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name   string
+		bucket tokenBucket
+		after  time.Duration
+		tokens float64
+		wait   time.Duration
+	}{
+		{"new bucket is full", tokenBucket{}, 0, 10, 0},
+		{"refills", tokenBucket{tokens: 0, at: testNow}, 3 * time.Second, 3, 0},
+		{"refills up to the burst", tokenBucket{tokens: 2, at: testNow}, time.Hour, 10, 0},
+		{"waits for a token", tokenBucket{tokens: 0.25, at: testNow}, 0, 0.25, 750 * time.Millisecond},
+		{"waits less after a while", tokenBucket{tokens: 0, at: testNow}, 500 * time.Millisecond, 0.5, 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := test.bucket
+			now := testNow.Add(test.after)
+			bucket.refill(60, 10, now)
+			if bucket.tokens != test.tokens {
+				t.Errorf("tokens = %v, want %v", bucket.tokens, test.tokens)
+			}
+			if !bucket.at.Equal(now) {
+				t.Errorf("at = %v, want %v", bucket.at, now)
+			}
+			if wait := bucket.wait(60); wait != test.wait {
+				t.Errorf("wait() = %v, want %v", wait, test.wait)
+			}
+		})
+	}
+}
+
+func TestParseTrustedNets(t *testing.T) {
+	tests := []struct {
+		nets string
+		want []string
+		ok   bool
+	}{
+		{"", []string{}, true},
+		{"10.0.0.0/8, 192.0.2.7,::1", []string{"10.0.0.0/8", "192.0.2.7/32", "::1/128"}, true},
+		{"10.1.2.3/8", []string{"10.0.0.0/8"}, true},
+		{"::ffff:1.2.3.4", []string{"1.2.3.4/32"}, true},
+		{"2001:db8::1/48", []string{"2001:db8::/48"}, true},
+		{"300.1.1.1/8", nil, false},
+		{"10.0.0.0/33", nil, false},
+		{"nope", nil, false},
+		{"10.0.0.1,", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.nets, func(t *testing.T) {
+			nets, err := parseTrustedNets(test.nets)
+			if (err == nil) != test.ok {
+				t.Fatalf("parseTrustedNets(%q) error = %v, want ok %v", test.nets, err, test.ok)
+			}
+			got := []string{}
+			for _, prefix := range nets {
+				got = append(got, prefix.String())
+			}
+			if test.ok && !slices.Equal(got, test.want) {
+				t.Errorf("parseTrustedNets(%q) = %v, want %v", test.nets, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsTrusted(t *testing.T) {
+	nets, err := parseTrustedNets("10.0.0.0/8,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := trustedNets
+	trustedNets = nets
+	t.Cleanup(func() { trustedNets = old })
+
+	tests := map[string]bool{
+		"10.1.2.3":    true,
+		"11.0.0.1":    false,
+		"2001:db8::7": true,
+		"2001:db9::7": false,
+	}
+	for addr, want := range tests {
+		if got := isTrusted(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isTrusted(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.7":                "192.0.2.7",
+		"2001:db8:1:2:3:4:5:6":     "2001:db8:1:2::/64",
+		"2001:db8:1:2:ffff::1":     "2001:db8:1:2::/64",
+		"2001:db8:1:3::1":          "2001:db8:1:3::/64",
+		"fe80::1234:5678:9abc:def": "fe80::/64",
+	}
+	for addr, want := range tests {
+		if got := clientKey(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("clientKey(%s) = %s, want %s", addr, got, want)
+		}
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,6 +24,29 @@ const (
 	// linkExistsTable is the name of the table that maps links's hashes to keys.
 	linkExistsTable = "linkhashes"
 
+	// linkMetaTable is the name of the table that maps keys to their metadata.
+	linkMetaTable = "linkmeta"
+
+	// linkHistoryTable is the name of the table that maps keys to their
+	// previous links.
+	linkHistoryTable = "linkhistory"
+
+	// linkExpiryTable is the name of the sorted set of keys scored by when
+	// they expire.
+	linkExpiryTable = "linkexpiry"
+
+	// linkStatsPrefix prefixes the name of each key's stats table, see
+	// linkStatsTable.
+	linkStatsPrefix = "linkstats:"
+
+	// linkVisitorsPrefix prefixes the name of each key's visitors tables, see
+	// linkVisitorsTable.
+	linkVisitorsPrefix = "linkvisitors:"
+
+	// visitorSaltTable is the name of the table that maps days to the salt
+	// of the visitors' hashes on that day.
+	visitorSaltTable = "visitorsalt"
+
 	// monokumaUsernameEnv is the name of the environment variable that contains
 	// the username for the redis server.
 	monokumaUsernameEnv = "MONOKUMA_REDIS_USER"
@@ -30,8 +55,14 @@ const (
 	// the password for the redis server.
 	monokumaPasswordEnv = "MONOKUMA_REDIS_PASS"
 
-	// customKeyMaxLength is the max number of characters in a custom key. Arbitrarily chosen.
-	customKeyMaxLength = 37
+	// monokumaSentinelPasswordEnv is the name of the environment variable that
+	// contains the password for the sentinels, if they have one.
+	monokumaSentinelPasswordEnv = "MONOKUMA_REDIS_SENTINEL_PASS"
+
+	// redisHashTag prefixes all the tables in cluster mode, so they're all in
+	// the same slot and the scripts can touch many of them at once, see
+	// redisPrefix.
+	redisHashTag = "{" + appName + "}"
 
 	connPusher = "pusher"
 	connGetter = "getter"
@@ -50,76 +81,135 @@ var (
 	// redisTLS is whether to use TLS for the redis connection.
 	redisTLS *bool
 
+	// redisSentinels are the comma-separated addresses of the sentinels, empty
+	// if redis is not behind sentinels.
+	redisSentinels *string
+	// redisMasterName is the name of the master the sentinels watch.
+	redisMasterName *string
+	// redisCluster are the comma-separated addresses of some of the cluster
+	// nodes, empty if redis is not a cluster.
+	redisCluster *string
+
 	// redisClientCert is the name of the redis client certificate file.
 	redisClientCert *string
 	// redisClientKey is the name of the redis client key file.
 	redisClientKey *string
 	// redisCustomCA is the name of the custom CA file.
 	redisCustomCA *string
+	// redisSystemRoots is whether to trust the system's CAs too.
+	redisSystemRoots *bool
+	// redisServerName is the name the server certificate is checked for,
+	// empty for the host.
+	redisServerName *string
+	// redisTLSReload is how often to check if the certificates changed.
+	redisTLSReload *time.Duration
+
+	// redisURL is the redis:// or rediss:// URL of the redis server, it takes
+	// the place of the host, port, database, and credentials flags.
+	redisURL *string
 
 	// redisUsername is the username for the redis server.
 	redisUsername *string = nil
-	// redisPassword is the password for the redis server.
-	redisPassword *string = nil
-
-	// maxNumGenTries is the maximum number of times to try to generate a unique key.
-	maxNumGenTries *int
+	// redisPassFile is the file with the password for the redis server, like
+	// a mounted docker or kubernetes secret.
+	redisPassFile *string
+	// redisNoPass is whether the redis user has no password (the "nopass" rule).
+	redisNoPass *bool
 )
 
-// errKeyExists is returned when a key already exists
-var errKeyExists = errors.New("key already exists")
-
-// dangan is a redis client, with two connections: one for pushing and one for
-// getting. This is done because redis does not allow a single connection to
-// both push and get.
+// dangan is a redis client, with two clients: one for pushing and one for
+// getting, so that slow writes never hold up the redirects. Each client has
+// its own pool of connections, which are re-established when they break.
 type dangan struct {
 	// rdb is the main redis client used for admin purposes (e.g. flushing the
 	// database)
-	rdb *redis.Client
+	rdb redis.UniversalClient
 	// pusher is the redis client used for pushing new links and keys.
-	pusher *redis.Conn
+	pusher redis.UniversalClient
 	// getter is the redis client used for getting links from keys.
-	getter *redis.Conn
+	getter redis.UniversalClient
+	// prefix prefixes the names of the tables, see table and redisPrefix.
+	prefix string
+	// namespace is the namespace of the tables, empty for none.
+	namespace string
+	// cluster is whether redis is a cluster.
+	cluster bool
 }
 
 // NewDangan creates a new dangan client.
 func NewDangan() *dangan {
-	// check if the redis username and password are set
-	if len(*redisUsername) < 1 { // not given by flags
-		if redisUsername = getEnv(monokumaUsernameEnv); redisUsername == nil { // not given by env
-			fmt.Printf("username must be provided through env var %s or --redis-user\n", monokumaUsernameEnv)
+	// Let's set the general options.
+	options := &redis.UniversalOptions{
+		Addrs: []string{*redisHost + ":" + rei.Itoa(*redisPort)},
+		DB:    *redisDB,
+		// retry the commands on broken connections with backoff.
+		MaxRetries:      3,
+		MinRetryBackoff: 50 * time.Millisecond,
+		MaxRetryBackoff: time.Second,
+		DialTimeout:     2 * time.Second,
+	}
+	options.Dialer = getRedisDialer(options.DialTimeout)
+
+	// the url takes the place of the host, port, and database flags.
+	urlUsername, urlPassword := "", ""
+	if len(*redisURL) > 0 {
+		parsed, err := redis.ParseURL(*redisURL)
+		if err != nil {
+			fmt.Printf("redis url is invalid: %v\n", err)
 			os.Exit(1)
 		}
+		options.Addrs, options.DB = []string{parsed.Addr}, parsed.DB
+		urlUsername, urlPassword = parsed.Username, parsed.Password
+		// rediss:// is TLS, with our certificates if -redis-tls is on.
+		if parsed.TLSConfig != nil && options.Dialer == nil {
+			options.TLSConfig = parsed.TLSConfig
+		}
 	}
-	if redisPassword = getEnv(monokumaPasswordEnv); redisPassword == nil {
-		fmt.Printf("warning: password not given in %s, will attempt to use nopass\n", monokumaPasswordEnv)
-	}
+	options.Username, options.Password = redisCredentials(urlUsername, urlPassword)
 
-	// if user gave us credentials, then they might be using the "nopass" directive, where
-	// any given password will work.
-	if redisPassword == nil {
-		// assigning a pointer requires an lval address available
-		passlval := strings.Clone(anyPasswordWillWorkForNoPass)
-		redisPassword = &passlval
+	// keep the tables of many shorteners apart.
+	if len(*redisNamespace) > 0 {
+		if err := validNamespace(*redisNamespace); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	}
 
-	// Let's set the general options.
-	options := &redis.Options{
-		Addr:      *redisHost + ":" + rei.Itoa(*redisPort),
-		DB:        *redisDB,
-		Username:  *redisUsername,
-		Password:  *redisPassword,
-		TLSConfig: getRedisTLSConfig(),
+	// find the master through the sentinels, or the nodes of the cluster.
+	switch {
+	case len(*redisSentinels) > 0 && len(*redisCluster) > 0:
+		fmt.Println("redis can be behind sentinels or a cluster, not both")
+		os.Exit(1)
+	case len(*redisSentinels) > 0:
+		if len(*redisMasterName) < 1 {
+			fmt.Println("master name must be provided through --redis-master with sentinels")
+			os.Exit(1)
+		}
+		options.Addrs = splitAddrs(*redisSentinels)
+		options.MasterName = *redisMasterName
+		if sentinelPassword := getEnv(monokumaSentinelPasswordEnv); sentinelPassword != nil {
+			options.SentinelPassword = *sentinelPassword
+		}
+	case len(*redisCluster) > 0:
+		if options.DB != 0 {
+			fmt.Println("redis cluster only has database 0")
+			os.Exit(1)
+		}
+		options.Addrs = splitAddrs(*redisCluster)
+		options.IsClusterMode = true
 	}
 
 	// create a new redis client
-	rdb := redis.NewClient(options)
+	rdb := redis.NewUniversalClient(options)
 
 	// check if the redis server is reachable
 	d := &dangan{
-		rdb:    rdb,
-		pusher: getConnection(rdb, connPusher),
-		getter: getConnection(rdb, connGetter),
+		rdb:       rdb,
+		pusher:    getClient(options, connPusher),
+		getter:    getClient(options, connGetter),
+		prefix:    redisPrefix(*redisNamespace, options.IsClusterMode),
+		namespace: *redisNamespace,
+		cluster:   options.IsClusterMode,
 	}
 
 	// start the keep alive loop
@@ -129,179 +219,311 @@ func NewDangan() *dangan {
 }
 
 const (
-	// maxNumKeepAliveFailures is the maximum number of times to fail to ping
-	// redis before exiting.
+	// maxNumKeepAliveFailures is the maximum number of keep-alive rounds in a
+	// row that can fail to ping redis before exiting.
 	maxNumKeepAliveFailures = 100
 )
 
-// keepAlive pings the redis server every 10 seconds to keep the connection alive.
+// keepAlive pings the redis server every 10 seconds to keep the connections
+// alive. Broken connections are replaced by the clients on their own, but if
+// redis doesn't answer for maxNumKeepAliveFailures rounds in a row and there's
+// no snapshot to serve, we give up.
 func (d *dangan) keepAlive() {
 	numFailures := 0
 
 	// ping the redis server with the given name.
-	// if there's an error, log it and increment the number of failures.
-	// if there's no error, reset the number of failures.
-	pinger := func(name string, cmd redis.Cmdable) {
+	// if there's an error, log it and return false.
+	pinger := func(name string, cmd redis.Cmdable) bool {
 		_, err := cmd.Ping(context.Background()).Result()
 		if err != nil {
 			log.Printf("pinging redis on %s: %v\n", name, err)
-			numFailures++
+			redisKeepAliveFailures.WithLabelValues(name).Inc()
+			storeHealth.recordError(fmt.Errorf("pinging redis on %s: %w", name, err))
+			return false
 		}
-		numFailures = 0
+		return true
 	}
 
 	for {
-		// if we've failed too many times, exit.
-		if numFailures > maxNumKeepAliveFailures*3 {
-			log.Fatalf("ping failed %d times", numFailures)
+		// ping the redis server, every connection has to answer.
+		ok := pinger("client", d.rdb)
+		ok = pinger(connGetter, d.getter) && ok
+		ok = pinger(connPusher, d.pusher) && ok
+
+		// if there's no error, reset the number of failures.
+		if ok {
+			if numFailures > 0 {
+				log.Printf("redis is back after %d failed pings", numFailures)
+			}
+			numFailures = 0
+		} else {
+			numFailures++
 		}
 
-		// ping the redis server
-		pinger("client", d.rdb)
-		pinger(connGetter, d.getter)
-		pinger(connPusher, d.pusher)
+		// if we've failed too many times, exit, unless the redirects can
+		// still be served from the snapshot.
+		if links, _ := snapshot.size(); numFailures >= maxNumKeepAliveFailures && links < 1 {
+			log.Fatalf("ping failed %d times in a row", numFailures)
+		}
 		time.Sleep(10 * time.Second)
 	}
 }
 
-// getRedisTLSConfig creates a new TLS config for the redis connection.
-// If redisTLS is false, it will return nil.
-func getRedisTLSConfig() *tls.Config {
+// getRedisDialer creates the dialer of the redis TLS connections, see
+// redisCerts.dialer. If redisTLS is false, it will return nil.
+func getRedisDialer(timeout time.Duration) func(context.Context, string, string) (net.Conn, error) {
 	// if redisTLS is false, return nil.
 	if !*redisTLS {
 		return nil
 	}
 
-	// check if the redis client certificate and key exist.
-	pathMustExist(*redisClientCert, "redis client certificate")
-	pathMustExist(*redisClientKey, "redis client key")
-
-	// load the client certificate and key
-	tlsPair, err := tls.LoadX509KeyPair(*redisClientCert, *redisClientKey)
-	// if there's an error, panic.
+	// load the CAs and the client certificate and key, if any.
+	certs, err := loadRedisCerts(*redisCustomCA, *redisClientCert, *redisClientKey, *redisSystemRoots)
 	if err != nil {
-		log.Fatalf("loading redis client certificate and key: %v", err)
+		log.Fatalf("loading redis certificates: %v", err)
 	}
 
-	// create a new cert pool and add the custom CA to it.
-	caPool := x509.NewCertPool()
-	if rei.FileMustExist(*redisCustomCA) {
-		// load the custom CA if exists.
-		derCustomCA, err := os.ReadFile(*redisCustomCA)
-		if err != nil {
-			log.Fatalf("reading custom CA: %v", err)
+	// pick up the rotated certificates.
+	if *redisTLSReload > 0 {
+		go certs.watch(*redisTLSReload)
+	}
+	return certs.dialer(*redisServerName, timeout)
+}
+
+// redisCredentials returns the username and password for redis. The username
+// comes from the url, -redis-user, or the environment, and the password from
+// -redis-pass-file, the url, or the environment, the first one given wins.
+// Users without a password need -redis-nopass.
+func redisCredentials(urlUsername, urlPassword string) (string, string) {
+	username := cmp.Or(urlUsername, *redisUsername)
+	if len(username) < 1 { // not given by the url or flags
+		fromEnv := getEnv(monokumaUsernameEnv)
+		if fromEnv == nil { // not given by env
+			fmt.Printf("username must be provided through the redis url, --redis-user, or env var %s\n",
+				monokumaUsernameEnv)
+			os.Exit(1)
 		}
-		caCert, err := x509.ParseCertificate(derCustomCA)
+		username = *fromEnv
+	}
+
+	password := urlPassword
+	if len(*redisPassFile) > 0 {
+		fromFile, err := os.ReadFile(*redisPassFile)
 		if err != nil {
-			log.Fatalf("parsing custom CA: %v", err)
+			fmt.Printf("reading redis password file: %v\n", err)
+			os.Exit(1)
 		}
-		caPool.AddCert(caCert)
+		// secrets written by hand usually end with a newline.
+		password = strings.TrimRight(string(fromFile), "\r\n")
 	}
-
-	// return the TLS config.
-	return &tls.Config{
-		MinVersion:   tls.VersionTLS12,
-		RootCAs:      caPool,
-		Certificates: []tls.Certificate{tlsPair},
+	if fromEnv := getEnv(monokumaPasswordEnv); len(password) < 1 && fromEnv != nil {
+		password = *fromEnv
 	}
-}
 
-// getConnection creates a new connection to the redis server with the given name.
-func getConnection(rdb *redis.Client, name string) *redis.Conn {
-	conn := rdb.Conn()
-	if err := conn.ClientSetName(context.Background(), name).Err(); err != nil {
-		log.Fatalf("setting client name to %s: %v", name, err)
+	// the "nopass" rule lets any password in, so we send one that says why.
+	if *redisNoPass {
+		if len(password) > 0 {
+			fmt.Println("redis password is given, but so is --redis-nopass")
+			os.Exit(1)
+		}
+		return username, anyPasswordWillWorkForNoPass
 	}
-	// check if the connection is working
-	_, err := conn.Ping(context.Background()).Result()
-	if err != nil {
-		log.Fatalf("pinging redis on %s: %v", name, err)
+	if len(password) < 1 {
+		fmt.Printf("password must be provided through --redis-pass-file, the redis url, or env var %s "+
+			"(or use --redis-nopass if the user has no password)\n", monokumaPasswordEnv)
+		os.Exit(1)
 	}
-	return conn
+	return username, password
 }
 
-// writeLink writes a new link to the database. If customKey is provided, it
-// will be used as the key. Otherwise, a new key will be generated.
-func (d *dangan) writeLink(linkb64, customKey string) (key string, err error) {
-	hash, key, exists, err := d.isLinkAlreadyShortened(linkb64)
-	if err != nil {
-		return "", fmt.Errorf("link creation ('%s') hash check: %w", linkb64, err)
-	}
-	if exists {
-		return
-	}
-	// get a unique key for the link (if customKey is provided, it will be used)
-	key, err = d.getUniqueKey(customKey)
-	if err != nil {
-		if errors.Is(err, errKeyExists) {
-			return
+// splitAddrs splits the comma-separated addresses.
+func splitAddrs(addrs string) []string {
+	out := []string{}
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			out = append(out, addr)
 		}
-		err = fmt.Errorf("getting unique key for link ('%s'): %w", linkb64, err)
-		return
 	}
-	// save the link and key
-	err = d.pusher.HSet(context.TODO(), keyToLinkTable, key, linkb64).Err()
-	if err != nil {
-		err = fmt.Errorf("saving key and link (key='%s', link='%s'): %w", key, linkb64, err)
-		return
+	return out
+}
+
+// table returns the name of the table in redis. In cluster mode, all the tables
+// share redisHashTag, so the scripts can touch many of them at once.
+func (d *dangan) table(name string) string {
+	return d.prefix + name
+}
+
+// tables returns the names of the tables in redis, see table.
+func (d *dangan) tables(names ...string) []string {
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = d.table(name)
 	}
-	// save the hash of the link to check if it's already shortened later on (see isLinkAlreadyShortened)
-	err = d.pusher.HSet(context.TODO(), linkExistsTable, hash, key).Err()
+	return out
+}
+
+// getClient creates a new client of the redis server (or of the sentinels'
+// master, or of the cluster) with the given name, all of its connections are
+// named after it.
+func getClient(options *redis.UniversalOptions, name string) redis.UniversalClient {
+	named := *options
+	named.ClientName = name
+	client := redis.NewUniversalClient(&named)
+	// fail fast while redis is down, the breaker goes first so the rejected
+	// commands don't count as redis commands.
+	client.AddHook(newCircuitBreaker(name))
+	// time the commands of each client on its own.
+	client.AddHook(redisMetricsHook{conn: name})
+	// check if the connection is working
+	_, err := client.Ping(context.Background()).Result()
 	if err != nil {
-		err = fmt.Errorf("saving hash of link (link='%s', hash='%s'): %w", linkb64, hash, err)
+		// with a snapshot, the redirects work until redis is back.
+		if links, _ := snapshot.size(); links < 1 {
+			log.Fatalf("pinging redis on %s: %v", name, err)
+		}
+		log.Printf("pinging redis on %s: %v, serving the snapshot until it's back", name, err)
 	}
-	return
+	return client
 }
 
-// getUniqueKey returns a unique key. If customKey is provided, it will be used
-// as the key. Otherwise, a new key will be generated. If the key already
-// exists, an error is returned.
-func (d *dangan) getUniqueKey(customKey string) (string, error) {
-	// First, let's check if the custom key is provided and it's new
-	if len(customKey) > 0 {
-		// see if it's too long
-		if len(customKey) > customKeyMaxLength {
-			return "", fmt.Errorf("custom key is too long, max size is %d", customKeyMaxLength)
-		}
-		// Check the key against the regular expression.
-		if !keyRegexp.MatchString(customKey) {
-			return "", fmt.Errorf("key %s is invalid, needs to match %s", customKey, keyRegexpPattern)
-		}
-		// move on
-		exists, err := d.keyExists(keyToLinkTable, customKey)
-		// some generic error
-		if err != nil {
-			return "", fmt.Errorf("existence of custom key ('%s'): %w", customKey, err)
-		}
-		// if it exists, send an error
-		if exists {
-			return "", fmt.Errorf("custom key already exists: %w", errKeyExists)
+// keySetLua are the Lua helpers for the sets of keys that links' hashes map to
+// in linkExistsTable, see splitKeys, addKey, and removeKey.
+const keySetLua = `
+local function split_keys(set)
+	local keys = {}
+	for key in string.gmatch(set or '', '[^,]+') do
+		table.insert(keys, key)
+	end
+	return keys
+end
+local function add_key(set, key)
+	local keys = split_keys(set)
+	for _, k in ipairs(keys) do
+		if k == key then
+			return set
+		end
+	end
+	table.insert(keys, key)
+	return table.concat(keys, ',')
+end
+local function remove_hash_key(table_name, hash, key)
+	local keys = {}
+	for _, k in ipairs(split_keys(redis.call('HGET', table_name, hash))) do
+		if k ~= key then
+			table.insert(keys, k)
+		end
+	end
+	if #keys == 0 then
+		redis.call('HDEL', table_name, hash)
+	else
+		redis.call('HSET', table_name, hash, table.concat(keys, ','))
+	end
+end
+`
+
+// Results of claimLinkScript.
+const (
+	// claimClaimed means the key is now the link's.
+	claimClaimed int64 = iota
+	// claimDeduped means the link is already shortened under another key.
+	claimDeduped
+	// claimTaken means the key belongs to another link.
+	claimTaken
+	// claimExpired means the key belongs to an expired link that wasn't swept yet.
+	claimExpired
+)
+
+// claimLinkScript atomically claims a key for a link. It returns a pair of
+// the result (see claimClaimed and friends) and the key that the link is now
+// shortened under. If the key is free, it saves the key, adds it to the set
+// of keys of the link's hash, and saves the metadata and the expiry all
+// together, so the tables never disagree. Expired and disabled keys don't
+// count when deduping, and unless aliasing, the link's first followable key
+// is returned.
+//
+// KEYS[1] is keyToLinkTable, KEYS[2] is linkExistsTable, KEYS[3] is linkMetaTable,
+// KEYS[4] is linkExpiryTable.
+// ARGV[1] is the key, ARGV[2] is the link, ARGV[3] is the link's hash,
+// ARGV[4] is the encoded metadata, ARGV[5] is the expiry (0 for never),
+// ARGV[6] is the current unix time, ARGV[7] is 1 to alias instead of dedupe.
+var claimLinkScript = redis.NewScript(keySetLua + `
+local now = tonumber(ARGV[6])
+local function alive(key)
+	local expires = redis.call('ZSCORE', KEYS[4], key)
+	return not expires or tonumber(expires) > now
+end
+local function disabled(key)
+	local meta = redis.call('HGET', KEYS[3], key)
+	return meta and (cjson.decode(meta).disabled or 0) ~= 0
+end
+local existing = redis.call('HGET', KEYS[2], ARGV[3])
+if ARGV[7] ~= '1' then
+	for _, key in ipairs(split_keys(existing)) do
+		if alive(key) and not disabled(key) then
+			return {1, key}
+		end
+	end
+end
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 then
+	if alive(ARGV[1]) then
+		return {2, ''}
+	end
+	return {3, ''}
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[3], add_key(existing, ARGV[1]))
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[4])
+if tonumber(ARGV[5]) > 0 then
+	redis.call('ZADD', KEYS[4], ARGV[5], ARGV[1])
+end
+return {0, ARGV[1]}
+`)
+
+// writeLink writes a new link with its metadata to the database. If
+// customKey is provided, it will be used as the key. Otherwise, a new key
+// will be generated. If alias is set, the link gets the new key even if it's
+// already shortened.
+func (d *dangan) writeLink(linkb64, customKey string, meta linkMeta, alias bool) (key string, deduped bool, err error) {
+	hash := rei.Sha256([]byte(linkb64))
+	// claim the key and save the hash of the link to check if it's already
+	// shortened later on (see isLinkAlreadyShortened) in one go.
+	claim := func(key string) (string, bool, error) {
+		for i := 0; i < maxNumChangeTries; i++ {
+			now := time.Now().Unix()
+			res, err := claimLinkScript.Run(context.TODO(), d.pusher,
+				d.tables(keyToLinkTable, linkExistsTable, linkMetaTable, linkExpiryTable),
+				key, linkb64, hash, encodeLinkMeta(meta), meta.Expires, now, alias).Slice()
+			if err != nil {
+				return "", false, fmt.Errorf("saving key and link (key='%s', link='%s', hash='%s'): %w",
+					key, linkb64, hash, err)
+			}
+			switch res[0].(int64) {
+			case claimTaken:
+				return "", false, errKeyExists
+			case claimExpired:
+				// sweep the expired key ourselves and try again.
+				if _, err := d.deleteExpiredLink(key, now); err != nil {
+					return "", false, fmt.Errorf("sweeping expired key ('%s'): %w", key, err)
+				}
+				continue
+			}
+			return res[1].(string), res[0].(int64) == claimDeduped, nil
 		}
-		return customKey, nil
+		return "", false, fmt.Errorf("claiming key ('%s'): key kept changing after %d tries",
+			key, maxNumChangeTries)
 	}
-	// Now, let's try generate the key until we find a unique one or we reach the
-	// maximum number of tries (maxNumGenTries).
-	for i := 0; i < *maxNumGenTries; i++ {
-		key := gen()
-		exists, err := d.keyExists(keyToLinkTable, key)
-		if err != nil {
-			return "",
-				fmt.Errorf("existence of generated key #%d ('%s'): %w", i+1, key, err)
-		}
-		// try again
-		if exists {
-			continue
-		}
-		return key, nil
+	// get a unique key for the link (if customKey is provided, it will be used)
+	key, deduped, err = getUniqueKey(claim, customKey)
+	if err != nil && !errors.Is(err, errKeyExists) {
+		err = fmt.Errorf("getting unique key for link ('%s'): %w", linkb64, err)
 	}
-	// We failed to generate a unique key after maxNumGenTries--sad
-	return "", fmt.Errorf("couldn't generate a unique key after %d tries", maxNumGenTries)
+	return
 }
 
 // exportLinks returns all the links in the database in the format:
 // key,link
 func (d *dangan) exportLinks() ([]string, error) {
-	links, err := d.getter.HGetAll(context.Background(), keyToLinkTable).Result()
+	links, err := d.getter.HGetAll(context.Background(), d.table(keyToLinkTable)).Result()
 	if err != nil {
 		return nil, fmt.Errorf("getting all links: %w", err)
 	}
@@ -312,11 +534,20 @@ func (d *dangan) exportLinks() ([]string, error) {
 	return out, nil
 }
 
+// exportLinkMeta returns the metadata of all the links in the database by key.
+func (d *dangan) exportLinkMeta() (map[string]linkMeta, error) {
+	encoded, err := d.getter.HGetAll(context.Background(), d.table(linkMetaTable)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("getting all metadata: %w", err)
+	}
+	return decodeLinkMetas(encoded)
+}
+
 // keyExists returns true if the given key exists in the given hash table. It
 // returns false if the key does not exist. If there is an error, it returns
 // false and the error.
 func (d *dangan) keyExists(table, key string) (bool, error) {
-	_, err := d.getter.HGet(context.TODO(), table, key).Result()
+	_, err := d.getter.HGet(context.TODO(), d.table(table), key).Result()
 	// exists
 	if err == nil {
 		return true, nil
@@ -332,7 +563,7 @@ func (d *dangan) keyExists(table, key string) (bool, error) {
 // getLink returns the link for the given key. If the key does not exist, it
 // returns an empty string, false, and nil error.
 func (d *dangan) getLink(key string) (link string, found bool, err error) {
-	link, err = d.getter.HGet(context.TODO(), keyToLinkTable, key).Result()
+	link, err = d.getter.HGet(context.TODO(), d.table(keyToLinkTable), key).Result()
 	// key does not exist
 	if err == redis.Nil {
 		err = nil
@@ -348,14 +579,14 @@ func (d *dangan) getLink(key string) (link string, found bool, err error) {
 }
 
 // isLinkAlreadyShortened checks if the link is already shortened. If it is,
-// it returns the hash, key, exists, and nil error. If it isn't, it returns
-// empty hash and key, false exists, and nil error.
+// it returns the hash, all of its keys, exists, and nil error. If it isn't, it
+// returns the hash, no keys, false exists, and nil error.
 func (d *dangan) isLinkAlreadyShortened(linkb64 string) (
-	hash string, key string, exists bool, err error,
+	hash string, keys []string, exists bool, err error,
 ) {
 	// Check if the link's hash is already stored
 	hash = rei.Sha256([]byte(linkb64))
-	key, err = d.getter.HGet(context.TODO(), linkExistsTable, hash).Result()
+	set, err := d.getter.HGet(context.TODO(), d.table(linkExistsTable), hash).Result()
 	if err != nil {
 		if err == redis.Nil {
 			// does not exist
@@ -365,10 +596,530 @@ func (d *dangan) isLinkAlreadyShortened(linkb64 string) (
 		}
 		return
 	}
-	exists = true
+	keys = splitKeys(set)
+	exists = len(keys) > 0
 	return
 }
 
+// deleteLinkScript atomically removes a key, its metadata, its history, its
+// expiry, its stats, and the key from its link's hash (the hash goes with its
+// last key). It
+// returns 0 if the key does not exist (or hasn't expired by the given time)
+// and -1 if the key's link is not the expected one anymore.
+//
+// KEYS[1] is keyToLinkTable, KEYS[2] is linkExistsTable, KEYS[3] is linkMetaTable,
+// KEYS[4] is linkHistoryTable, KEYS[5] is linkExpiryTable, KEYS[6] is the key's
+// linkStatsTable, the rest are the key's linkVisitorsTable of all time and of
+// each day.
+// ARGV[1] is the key, ARGV[2] is the expected link, ARGV[3] is the link's hash,
+// ARGV[4] is the unix time the key must have expired by (0 to delete anyway).
+var deleteLinkScript = redis.NewScript(keySetLua + `
+local link = redis.call('HGET', KEYS[1], ARGV[1])
+if not link then
+	return 0
+end
+if link ~= ARGV[2] then
+	return -1
+end
+if tonumber(ARGV[4]) > 0 then
+	local expires = redis.call('ZSCORE', KEYS[5], ARGV[1])
+	if not expires or tonumber(expires) > tonumber(ARGV[4]) then
+		return 0
+	end
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('ZREM', KEYS[5], ARGV[1])
+for i = 6, #KEYS do
+	redis.call('DEL', KEYS[i])
+end
+remove_hash_key(KEYS[2], ARGV[3], ARGV[1])
+return 1
+`)
+
+// maxNumChangeTries is how many times to try changing a key whose link keeps
+// changing under us.
+const maxNumChangeTries = 10
+
+// deleteLink removes the key, its link's hash, its metadata, its history, and
+// its stats from the database. It returns false if the key did not exist.
+func (d *dangan) deleteLink(key string) (bool, error) {
+	return d.removeLink(key, 0)
+}
+
+// deleteExpiredLink is deleteLink, but only if the key has expired by now.
+func (d *dangan) deleteExpiredLink(key string, now int64) (bool, error) {
+	return d.removeLink(key, now)
+}
+
+// removeLink removes the key and everything about it. If expiredBy is not
+// zero, the key is only removed if it has expired by then.
+func (d *dangan) removeLink(key string, expiredBy int64) (found bool, err error) {
+	for i := 0; i < maxNumChangeTries; i++ {
+		link, found, err := d.getLink(key)
+		if err != nil || !found {
+			return found, err
+		}
+		hash := rei.Sha256([]byte(link))
+		tables := d.tables(keyToLinkTable, linkExistsTable, linkMetaTable, linkHistoryTable, linkExpiryTable,
+			linkStatsTable(key), linkVisitorsTable(key, ""))
+		// the visitors of each day are in their own tables, one for each day
+		// with clicks.
+		fields, err := d.getter.HKeys(context.TODO(), d.table(linkStatsTable(key))).Result()
+		if err != nil {
+			return false, fmt.Errorf("retrieving stats for key ('%s'): %w", key, err)
+		}
+		for _, day := range statsDays(fields) {
+			tables = append(tables, d.table(linkVisitorsTable(key, day)))
+		}
+		deleted, err := deleteLinkScript.Run(context.TODO(), d.pusher, tables,
+			key, link, hash, expiredBy).Int()
+		if err != nil {
+			return false, fmt.Errorf("deleting key and hash (key='%s', hash='%s'): %w", key, hash, err)
+		}
+		// the link changed since we read it, try again.
+		if deleted < 0 {
+			continue
+		}
+		return deleted > 0, nil
+	}
+	return false, fmt.Errorf("deleting key ('%s'): link kept changing after %d tries", key, maxNumChangeTries)
+}
+
+// expiredKeys returns the keys that have expired by now.
+func (d *dangan) expiredKeys(now int64) ([]string, error) {
+	keys, err := d.getter.ZRangeByScore(context.TODO(), d.table(linkExpiryTable), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("getting expired keys: %w", err)
+	}
+	return keys, nil
+}
+
+// updateLinkScript atomically points a key to a new link. The key is moved
+// from the old link's hash to the new link's hash (becoming an alias if the
+// new link is already shortened), and the old link is appended to the key's
+// history. It returns 0 if the key does
+// not exist and -1 if the key's link is not the expected one anymore.
+//
+// KEYS[1] is keyToLinkTable, KEYS[2] is linkExistsTable, KEYS[3] is linkHistoryTable.
+// ARGV[1] is the key, ARGV[2] is the expected old link, ARGV[3] is the old
+// link's hash, ARGV[4] is the new link, ARGV[5] is the new link's hash,
+// ARGV[6] is the history entry for the old link.
+var updateLinkScript = redis.NewScript(keySetLua + `
+local link = redis.call('HGET', KEYS[1], ARGV[1])
+if not link then
+	return 0
+end
+if link ~= ARGV[2] then
+	return -1
+end
+if link == ARGV[4] then
+	return 1
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[4])
+remove_hash_key(KEYS[2], ARGV[3], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[5], add_key(redis.call('HGET', KEYS[2], ARGV[5]), ARGV[1]))
+local history = redis.call('HGET', KEYS[3], ARGV[1]) or ''
+redis.call('HSET', KEYS[3], ARGV[1], history .. ARGV[6])
+return 1
+`)
+
+// updateLink points the key to a new link, moving the key to the new link's
+// hash and saving the old link in the key's history. It returns false if the
+// key does not exist.
+func (d *dangan) updateLink(key, linkb64 string) (found bool, err error) {
+	newHash := rei.Sha256([]byte(linkb64))
+	for i := 0; i < maxNumChangeTries; i++ {
+		link, found, err := d.getLink(key)
+		if err != nil || !found {
+			return found, err
+		}
+		hash := rei.Sha256([]byte(link))
+		entry := encodeLinkHistoryEntry(linkHistoryEntry{Replaced: time.Now().Unix(), Link: link})
+		updated, err := updateLinkScript.Run(context.TODO(), d.pusher,
+			d.tables(keyToLinkTable, linkExistsTable, linkHistoryTable),
+			key, link, hash, linkb64, newHash, entry).Int()
+		if err != nil {
+			return false, fmt.Errorf("updating key (key='%s', link='%s'): %w", key, linkb64, err)
+		}
+		// the link changed since we read it, try again.
+		if updated < 0 {
+			continue
+		}
+		return updated > 0, nil
+	}
+	return false, fmt.Errorf("updating key ('%s'): link kept changing after %d tries", key, maxNumChangeTries)
+}
+
+// getLinkHistory returns the links the key pointed to before, oldest first.
+func (d *dangan) getLinkHistory(key string) ([]linkHistoryEntry, error) {
+	encoded, err := d.getter.HGet(context.TODO(), d.table(linkHistoryTable), key).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("retrieving history for key ('%s'): %w", key, err)
+	}
+	return decodeLinkHistory(encoded)
+}
+
+// getLinkMeta returns the metadata of the key, empty if there is none.
+func (d *dangan) getLinkMeta(key string) (linkMeta, error) {
+	encoded, err := d.getter.HGet(context.TODO(), d.table(linkMetaTable), key).Result()
+	if err != nil && err != redis.Nil {
+		return linkMeta{}, fmt.Errorf("retrieving metadata for key ('%s'): %w", key, err)
+	}
+	return decodeLinkMeta(encoded)
+}
+
+// setLinkMetaScript saves the metadata of a key only if the key exists. It
+// returns 1 if the key exists, 0 otherwise.
+//
+// KEYS[1] is keyToLinkTable, KEYS[2] is linkMetaTable.
+// ARGV[1] is the key, ARGV[2] is the encoded metadata.
+var setLinkMetaScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+// setLinkMeta saves the metadata of the key. It returns false if the key
+// does not exist.
+func (d *dangan) setLinkMeta(key string, meta linkMeta) (bool, error) {
+	found, err := setLinkMetaScript.Run(context.TODO(), d.pusher,
+		d.tables(keyToLinkTable, linkMetaTable), key, encodeLinkMeta(meta)).Bool()
+	if err != nil {
+		return false, fmt.Errorf("saving metadata for key ('%s'): %w", key, err)
+	}
+	return found, nil
+}
+
+// addLinkStatsScript adds counts to the stats fields of a key only if the key
+// exists.
+//
+// KEYS[1] is keyToLinkTable, KEYS[2] is the key's linkStatsTable.
+// ARGV[1] is the key, the rest are pairs of fields and counts.
+var addLinkStatsScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+for i = 2, #ARGV, 2 do
+	redis.call('HINCRBY', KEYS[2], ARGV[i], ARGV[i + 1])
+end
+return 1
+`)
+
+// addLinkStats adds the counts to the key's stats fields.
+func (d *dangan) addLinkStats(key string, counts map[string]int64) error {
+	args := make([]any, 0, 1+2*len(counts))
+	args = append(args, key)
+	for field, count := range counts {
+		args = append(args, field, count)
+	}
+	err := addLinkStatsScript.Run(context.TODO(), d.pusher,
+		d.tables(keyToLinkTable, linkStatsTable(key)), args...).Err()
+	if err != nil {
+		return fmt.Errorf("saving stats for key ('%s'): %w", key, err)
+	}
+	return nil
+}
+
+// getLinkStats returns the key's stats fields, empty if there are none.
+func (d *dangan) getLinkStats(key string) (map[string]int64, error) {
+	fields, err := d.getter.HGetAll(context.TODO(), d.table(linkStatsTable(key))).Result()
+	if err != nil {
+		return nil, fmt.Errorf("retrieving stats for key ('%s'): %w", key, err)
+	}
+	return decodeStatsFields(fields)
+}
+
+// addLinkVisitorsScript adds visitors to the all-time and daily visitors of a
+// key only if the key exists.
+//
+// KEYS[1] is keyToLinkTable, KEYS[2] is the key's linkVisitorsTable of all
+// time, KEYS[3] is the key's linkVisitorsTable of the day.
+// ARGV[1] is the key, the rest are the visitors.
+var addLinkVisitorsScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+local visitors = {unpack(ARGV, 2)}
+redis.call('PFADD', KEYS[2], unpack(visitors))
+redis.call('PFADD', KEYS[3], unpack(visitors))
+return 1
+`)
+
+// maxVisitorsPerScript is how many visitors are added by one run of
+// addLinkVisitorsScript, as lua can't unpack too many of them at once.
+const maxVisitorsPerScript = 1000
+
+// addLinkVisitors adds the hashed visitors of the day to the key's visitors,
+// counted with HyperLogLogs.
+func (d *dangan) addLinkVisitors(key, day string, visitors []string) error {
+	for batch := range slices.Chunk(visitors, maxVisitorsPerScript) {
+		args := make([]any, 0, 1+len(batch))
+		args = append(args, key)
+		for _, visitor := range batch {
+			args = append(args, visitor)
+		}
+		err := addLinkVisitorsScript.Run(context.TODO(), d.pusher,
+			d.tables(keyToLinkTable, linkVisitorsTable(key, ""), linkVisitorsTable(key, day)), args...).Err()
+		if err != nil {
+			return fmt.Errorf("saving visitors for key ('%s'): %w", key, err)
+		}
+	}
+	return nil
+}
+
+// countLinkVisitors returns the approximate number of the key's visitor days
+// and unique visitors of each of the given days.
+func (d *dangan) countLinkVisitors(key string, days []string) (int64, map[string]int64, error) {
+	counts := make([]*redis.IntCmd, len(days))
+	var visitorDays *redis.IntCmd
+	_, err := d.getter.Pipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		visitorDays = pipe.PFCount(context.TODO(), d.table(linkVisitorsTable(key, "")))
+		for i, day := range days {
+			counts[i] = pipe.PFCount(context.TODO(), d.table(linkVisitorsTable(key, day)))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("counting visitors for key ('%s'): %w", key, err)
+	}
+	daily := make(map[string]int64, len(days))
+	for i, day := range days {
+		daily[day] = counts[i].Val()
+	}
+	return visitorDays.Val(), daily, nil
+}
+
+// visitorSalt returns the salt of the visitors' hashes on the day. Each salt
+// is its own key that expires when the day after it is over, see
+// oldestSaltDay, so the old ones are forgotten by redis itself.
+func (d *dangan) visitorSalt(day, fresh string) (string, error) {
+	start, err := time.Parse(time.DateOnly, day)
+	if err != nil {
+		return "", fmt.Errorf("bad day ('%s'): %w", day, err)
+	}
+	// late clicks of a day that's over still need its salt.
+	ttl := max(time.Until(start.Add(48*time.Hour)), time.Minute)
+	table := d.table(visitorSaltTable + ":" + day)
+	if err := d.pusher.SetNX(context.TODO(), table, fresh, ttl).Err(); err != nil {
+		return "", fmt.Errorf("setting visitor salt for day ('%s'): %w", day, err)
+	}
+	salt, err := d.pusher.Get(context.TODO(), table).Result()
+	if err != nil {
+		return "", fmt.Errorf("retrieving visitor salt for day ('%s'): %w", day, err)
+	}
+	return salt, nil
+}
+
+// createTokenScript saves a new API token only if there's no token with the
+// name, and forgets when a revoked token of the same name was last used. It
+// returns 1 if the token was saved, 0 otherwise.
+//
+// KEYS[1] is apiTokensTable, KEYS[2] is apiTokensUsedTable.
+// ARGV[1] is the name, ARGV[2] is the encoded token.
+var createTokenScript = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+return 1
+`)
+
+// createToken saves the new API token under the name.
+func (d *dangan) createToken(name string, token apiToken) error {
+	created, err := createTokenScript.Run(context.TODO(), d.pusher,
+		d.tables(apiTokensTable, apiTokensUsedTable), name, encodeApiToken(token)).Bool()
+	if err != nil {
+		return fmt.Errorf("saving token ('%s'): %w", name, err)
+	}
+	if !created {
+		return errTokenExists
+	}
+	return nil
+}
+
+// getToken returns the API token with the name.
+func (d *dangan) getToken(name string) (apiToken, bool, error) {
+	var encoded, lastUsed *redis.StringCmd
+	_, err := d.getter.Pipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		encoded = pipe.HGet(context.TODO(), d.table(apiTokensTable), name)
+		lastUsed = pipe.HGet(context.TODO(), d.table(apiTokensUsedTable), name)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return apiToken{}, false, fmt.Errorf("retrieving token ('%s'): %w", name, err)
+	}
+	if encoded.Err() == redis.Nil {
+		return apiToken{}, false, nil
+	}
+	token, err := decodeApiToken(encoded.Val(), lastUsed.Val())
+	return token, err == nil, err
+}
+
+// listTokens returns all the API tokens by name.
+func (d *dangan) listTokens() (map[string]apiToken, error) {
+	var encoded, lastUsed *redis.MapStringStringCmd
+	_, err := d.getter.Pipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		encoded = pipe.HGetAll(context.TODO(), d.table(apiTokensTable))
+		lastUsed = pipe.HGetAll(context.TODO(), d.table(apiTokensUsedTable))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing tokens: %w", err)
+	}
+	return decodeApiTokens(encoded.Val(), lastUsed.Val())
+}
+
+// deleteToken removes the API token with the name.
+func (d *dangan) deleteToken(name string) (bool, error) {
+	var deleted *redis.IntCmd
+	_, err := d.pusher.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		deleted = pipe.HDel(context.TODO(), d.table(apiTokensTable), name)
+		pipe.HDel(context.TODO(), d.table(apiTokensUsedTable), name)
+		pipe.HDel(context.TODO(), d.table(creationLimitsTable), name)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("deleting token ('%s'): %w", name, err)
+	}
+	return deleted.Val() > 0, nil
+}
+
+// touchTokenScript saves when an API token was last used only if the token
+// exists.
+//
+// KEYS[1] is apiTokensTable, KEYS[2] is apiTokensUsedTable.
+// ARGV[1] is the name, ARGV[2] is the unix time.
+var touchTokenScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+// touchToken saves that the API token was last used now.
+func (d *dangan) touchToken(name string, now int64) error {
+	err := touchTokenScript.Run(context.TODO(), d.pusher,
+		d.tables(apiTokensTable, apiTokensUsedTable), name, now).Err()
+	if err != nil {
+		return fmt.Errorf("saving last use of token ('%s'): %w", name, err)
+	}
+	return nil
+}
+
+// takeCreationScript counts a link creation of an API token if the limits
+// allow it, just like creationCounter.take, so the instances share the counter.
+// It returns whether they did and the counter after it.
+//
+// KEYS[1] is creationLimitsTable.
+// ARGV[1] is the name, ARGV[2..5] are the rate, burst, daily, and monthly
+// limits, ARGV[6] is the unix time in milliseconds, ARGV[7] is the day, and
+// ARGV[8] is the month.
+var takeCreationScript = redis.NewScript(`
+local rate, burst = tonumber(ARGV[2]), tonumber(ARGV[3])
+local daily, monthly = tonumber(ARGV[4]), tonumber(ARGV[5])
+local at = tonumber(ARGV[6])
+local encoded = redis.call('HGET', KEYS[1], ARGV[1])
+local counter
+if encoded then
+	counter = cjson.decode(encoded)
+	if at > counter.at then
+		counter.tokens = counter.tokens + (at - counter.at) * rate / 60000
+	end
+else
+	counter = {tokens = burst, day = '', daily = 0, month = '', monthly = 0}
+end
+counter.tokens = math.min(counter.tokens, burst)
+counter.at = at
+if counter.day ~= ARGV[7] then
+	counter.day, counter.daily = ARGV[7], 0
+end
+if counter.month ~= ARGV[8] then
+	counter.month, counter.monthly = ARGV[8], 0
+end
+local allowed = 1
+if (rate > 0 and counter.tokens < 1) or (daily > 0 and counter.daily >= daily) or
+	(monthly > 0 and counter.monthly >= monthly) then
+	allowed = 0
+else
+	if rate > 0 then
+		counter.tokens = counter.tokens - 1
+	end
+	counter.daily = counter.daily + 1
+	counter.monthly = counter.monthly + 1
+end
+encoded = cjson.encode(counter)
+redis.call('HSET', KEYS[1], ARGV[1], encoded)
+return {allowed, encoded}
+`)
+
+// takeCreation counts a link creation of the API token now, if the limits
+// allow it.
+func (d *dangan) takeCreation(name string, limits createLimits, now time.Time) (creationCounter, bool, error) {
+	utc := now.UTC()
+	result, err := takeCreationScript.Run(context.TODO(), d.pusher, d.tables(creationLimitsTable), name,
+		limits.Rate, limits.Burst, limits.Daily, limits.Monthly, now.UnixMilli(),
+		utc.Format(time.DateOnly), utc.Format(monthLayout)).Slice()
+	if err != nil {
+		return creationCounter{}, false, fmt.Errorf("counting creation of token ('%s'): %w", name, err)
+	}
+	allowed, _ := result[0].(int64)
+	encoded, _ := result[1].(string)
+	counter, err := decodeCreationCounter(encoded)
+	return counter, allowed == 1, err
+}
+
+// refundCreationScript gives back the quotas of a creation of an API token,
+// just like creationCounter.refund.
+//
+// KEYS[1] is creationLimitsTable.
+// ARGV[1] is the name, ARGV[2] is the day, and ARGV[3] is the month.
+var refundCreationScript = redis.NewScript(`
+local encoded = redis.call('HGET', KEYS[1], ARGV[1])
+if not encoded then
+	return 0
+end
+local counter = cjson.decode(encoded)
+if counter.day == ARGV[2] and counter.daily > 0 then
+	counter.daily = counter.daily - 1
+end
+if counter.month == ARGV[3] and counter.monthly > 0 then
+	counter.monthly = counter.monthly - 1
+end
+redis.call('HSET', KEYS[1], ARGV[1], cjson.encode(counter))
+return 1
+`)
+
+// refundCreation gives back the quotas of a creation of the API token taken
+// now that didn't create a new link.
+func (d *dangan) refundCreation(name string, now time.Time) error {
+	utc := now.UTC()
+	err := refundCreationScript.Run(context.TODO(), d.pusher, d.tables(creationLimitsTable), name,
+		utc.Format(time.DateOnly), utc.Format(monthLayout)).Err()
+	if err != nil {
+		return fmt.Errorf("refunding creation of token ('%s'): %w", name, err)
+	}
+	return nil
+}
+
+// ping checks that both the pusher and the getter connections answer.
+func (d *dangan) ping(ctx context.Context) error {
+	if err := d.pusher.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("pinging redis on %s: %w", connPusher, err)
+	}
+	if err := d.getter.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("pinging redis on %s: %w", connGetter, err)
+	}
+	return nil
+}
+
 // Close closes the dangan client.
 func (d *dangan) Close() {
 	// close the redis connections
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestDangan returns a dangan on a new miniredis, which runs the lua
+// scripts like redis does, with the tables prefixed like redisPrefix would.
+func newTestDangan(t *testing.T, namespace string, cluster bool) *dangan {
+	t.Helper()
+	return testDanganOn(miniredis.RunT(t), namespace, cluster)
+}
+
+// testDanganOn returns a dangan on the miniredis, in the namespace.
+func testDanganOn(server *miniredis.Miniredis, namespace string, cluster bool) *dangan {
+	client := func() *redis.Client { return redis.NewClient(&redis.Options{Addr: server.Addr()}) }
+	return &dangan{
+		rdb:       client(),
+		pusher:    client(),
+		getter:    client(),
+		prefix:    redisPrefix(namespace, cluster),
+		namespace: namespace,
+		cluster:   cluster,
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		cluster   bool
+	}{
+		{"no namespace", "", false},
+		{"namespace", "monokuma", false},
+		{"cluster", "monokuma", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testStore(t, func(t *testing.T) LinkStore {
+				return newTestDangan(t, test.namespace, test.cluster)
+			})
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// redisCerts are the certificates of the redis TLS connections. They're read
+// again when their files change, so rotated certificates are picked up by the
+// new connections without a restart, see watch.
+type redisCerts struct {
+	// caPath is the file with the CA certificates, empty for none.
+	caPath string
+	// certPath is the file with the client certificate, empty for none.
+	certPath string
+	// keyPath is the file with the client key.
+	keyPath string
+	// systemRoots is whether to trust the system's CAs too.
+	systemRoots bool
+
+	// mu guards the fields below.
+	mu sync.RWMutex
+	// roots are the CAs the server certificate has to be signed by.
+	roots *x509.CertPool
+	// cert is the client certificate, nil if there's none.
+	cert *tls.Certificate
+	// versions are the modification times and sizes of the files when they
+	// were read, to see if they changed.
+	versions map[string]string
+}
+
+// loadRedisCerts reads the certificates of the redis TLS connections.
+func loadRedisCerts(caPath, certPath, keyPath string, systemRoots bool) (*redisCerts, error) {
+	c := &redisCerts{caPath: caPath, certPath: certPath, keyPath: keyPath, systemRoots: systemRoots}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the certificates from their files.
+func (c *redisCerts) load() error {
+	versions := c.fileVersions()
+
+	roots := x509.NewCertPool()
+	if c.systemRoots {
+		system, err := x509.SystemCertPool()
+		if err != nil {
+			return fmt.Errorf("loading system CAs: %w", err)
+		}
+		roots = system
+	}
+	if len(c.caPath) > 0 {
+		encoded, err := os.ReadFile(c.caPath)
+		if err != nil {
+			return fmt.Errorf("reading CA: %w", err)
+		}
+		if err := addCAs(roots, encoded); err != nil {
+			return fmt.Errorf("parsing CA %s: %w", c.caPath, err)
+		}
+	}
+	if !c.systemRoots && len(c.caPath) < 1 {
+		return errors.New("no CA to check the server with, give one or use the system's")
+	}
+
+	var cert *tls.Certificate
+	if len(c.certPath) > 0 {
+		pair, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+		if err != nil {
+			return fmt.Errorf("loading client certificate and key: %w", err)
+		}
+		cert = &pair
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roots, c.cert, c.versions = roots, cert, versions
+	return nil
+}
+
+// addCAs adds the CA certificates to the pool, either PEM (any number of
+// them) or DER (one or more, one after another).
+func addCAs(pool *x509.CertPool, encoded []byte) error {
+	if bytes.Contains(encoded, []byte("-----BEGIN")) {
+		if !pool.AppendCertsFromPEM(encoded) {
+			return errors.New("no certificates in PEM")
+		}
+		return nil
+	}
+	certs, err := x509.ParseCertificates(encoded)
+	if err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return nil
+}
+
+// fileVersions returns the modification times and sizes of the files.
+func (c *redisCerts) fileVersions() map[string]string {
+	versions := map[string]string{}
+	for _, path := range []string{c.caPath, c.certPath, c.keyPath} {
+		if len(path) < 1 {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			versions[path] = fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return versions
+}
+
+// changed returns true if any of the files changed since they were read.
+func (c *redisCerts) changed() bool {
+	versions := c.fileVersions()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for path, version := range versions {
+		if c.versions[path] != version {
+			return true
+		}
+	}
+	return len(versions) != len(c.versions)
+}
+
+// watch reads the certificates again when their files change, checking every
+// interval, forever. Broken files are logged and the old certificates kept
+// until the files change again.
+func (c *redisCerts) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !c.changed() {
+			continue
+		}
+		if err := c.load(); err != nil {
+			log.Printf("reloading redis certificates, keeping the old ones: %v", err)
+			// don't try the broken files again until they change.
+			versions := c.fileVersions()
+			c.mu.Lock()
+			c.versions = versions
+			c.mu.Unlock()
+			continue
+		}
+		log.Printf("reloaded redis certificates")
+	}
+}
+
+// dialer returns the dialer of the redis TLS connections. Every server is
+// checked for serverName, or the host it's dialed at if empty, even if it's
+// an IP address.
+func (c *redisCerts) dialer(serverName string, timeout time.Duration) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("redis address %s is invalid: %w", addr, err)
+		}
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: timeout, KeepAlive: 5 * time.Minute},
+			Config:    c.tlsConfig(cmp.Or(serverName, host)),
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// tlsConfig returns the TLS config of a redis connection to the server with
+// the name. The server is checked against the current CAs and the current
+// client certificate is given, so they can change after the config is made.
+func (c *redisCerts) tlsConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		// not insecure, the server is checked in verifyServer instead, as the
+		// CAs can change.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return c.verifyServer(state, serverName)
+		},
+		GetClientCertificate: c.clientCertificate,
+	}
+}
+
+// verifyServer checks the server certificate against the current CAs and the
+// name, just like the TLS config would with RootCAs. The name is given, as the
+// connection state has none for IP addresses.
+func (c *redisCerts) verifyServer(state tls.ConnectionState, serverName string) error {
+	if len(state.PeerCertificates) < 1 {
+		return errors.New("redis server gave no certificate")
+	}
+	if len(serverName) < 1 {
+		return errors.New("redis server has no name to check its certificate for")
+	}
+	c.mu.RLock()
+	roots := c.roots
+	c.mu.RUnlock()
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// clientCertificate gives the current client certificate, or none.
+func (c *redisCerts) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return c.cert, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCA is a CA that signs the certificates of the test servers.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA creates a new CA.
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "monokuma test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+// serverCert returns a server certificate for the names and IPs.
+func (ca testCA) serverCert(t *testing.T, names []string, ips []net.IP) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "redis"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     names,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveTLS serves TLS with the certificate on a local port and returns its
+// address. The handshakes are done and the connections closed.
+func serveTLS(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestRedisCertsDialer(t *testing.T) {
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	certs := &redisCerts{roots: roots}
+
+	tests := []struct {
+		name       string
+		dnsNames   []string
+		ips        []net.IP
+		serverName string
+		ok         bool
+	}{
+		{"ip matches", nil, []net.IP{net.ParseIP("127.0.0.1")}, "", true},
+		{"wrong ip", nil, []net.IP{net.ParseIP("10.0.0.1")}, "", false},
+		{"name instead of ip", []string{"evil.example"}, nil, "", false},
+		{"server name matches", []string{"redis.example"}, nil, "redis.example", true},
+		{"wrong server name", []string{"evil.example"}, nil, "redis.example", false},
+		{"server name over ip", nil, []net.IP{net.ParseIP("127.0.0.1")}, "redis.example", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := serveTLS(t, ca.serverCert(t, test.dnsNames, test.ips))
+			conn, err := certs.dialer(test.serverName, time.Second)(context.Background(), "tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			if (err == nil) != test.ok {
+				t.Fatalf("dialing %s: got error %v, want ok %v", addr, err, test.ok)
+			}
+		})
+	}
+}
+
+func TestRedisCertsDialerUnknownCA(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(other.cert)
+	certs := &redisCerts{roots: roots}
+
+	addr := serveTLS(t, ca.serverCert(t, nil, []net.IP{net.ParseIP("127.0.0.1")}))
+	conn, err := certs.dialer("", time.Second)(context.Background(), "tcp", addr)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialing a server signed by an unknown CA succeeded")
+	}
+}
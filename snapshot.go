@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thecsw/rei"
+)
+
+var (
+	// snapshotPath is the file the snapshot of the links is kept in, empty
+	// for no snapshot.
+	snapshotPath *string
+	// snapshotInterval is how often the snapshot is taken while the store is up.
+	snapshotInterval *time.Duration
+	// storeCheckInterval is how often the store is pinged to see if it's down.
+	storeCheckInterval *time.Duration
+)
+
+// errStoreDown is returned by the writes while the store is down.
+var errStoreDown = errors.New("store is down, only redirects are served for now")
+
+// degraded is true while the store is down, then the redirects are served from
+// the snapshot and the writes answer with StoreUnavailable, see watchStore.
+var degraded atomic.Bool
+
+// snapshot has the links to serve the redirects from while the store is down.
+var snapshot = &linkSnapshot{links: map[string]snapshotLink{}}
+
+// snapshotLink is a link that can be followed, as the snapshot keeps it.
+type snapshotLink struct {
+	// Link is the link the key points to (not in base64).
+	Link string `json:"link"`
+	// Expires is the unix time when the link expires, 0 if it never does.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// linkSnapshot is a copy of the links that can be followed, the disabled ones
+// are left out. It's saved to snapshotPath, so it's there after a restart too.
+type linkSnapshot struct {
+	// mu guards the fields below.
+	mu sync.RWMutex
+	// taken is when the snapshot was taken.
+	taken time.Time
+	// links are the links by key.
+	links map[string]snapshotLink
+}
+
+// snapshotFile is how the snapshot is saved.
+type snapshotFile struct {
+	// Taken is when the snapshot was taken.
+	Taken time.Time `json:"taken"`
+	// Links are the links by key.
+	Links map[string]snapshotLink `json:"links"`
+}
+
+// get returns the link of the key, if it's there and hasn't expired by now.
+func (s *linkSnapshot) get(key string, now int64) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	link, ok := s.links[key]
+	if !ok || (link.Expires != 0 && link.Expires <= now) {
+		return "", false
+	}
+	return link.Link, true
+}
+
+// forget drops the key, so a deleted or changed link isn't served until the
+// next snapshot.
+func (s *linkSnapshot) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.links, key)
+}
+
+// size returns the number of links and when they were taken.
+func (s *linkSnapshot) size() (int, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.links), s.taken
+}
+
+// set replaces the links.
+func (s *linkSnapshot) set(links map[string]snapshotLink, taken time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links, s.taken = links, taken
+	snapshotLinks.Set(float64(len(links)))
+}
+
+// loadSnapshot loads the snapshot saved at path, if there is one.
+func loadSnapshot(path string) error {
+	encoded, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+	var file snapshotFile
+	if err := json.Unmarshal(encoded, &file); err != nil {
+		return fmt.Errorf("decoding snapshot %s: %w", path, err)
+	}
+	if file.Links == nil {
+		file.Links = map[string]snapshotLink{}
+	}
+	snapshot.set(file.Links, file.Taken)
+	return nil
+}
+
+// takeSnapshot copies the links that can be followed from the store and
+// saves them to path.
+func takeSnapshot(path string) error {
+	taken := time.Now()
+	links, err := monomi.exportLinks()
+	if err != nil {
+		return err
+	}
+	metas, err := monomi.exportLinkMeta()
+	if err != nil {
+		return err
+	}
+	out := make(map[string]snapshotLink, len(links))
+	for _, line := range links {
+		key, linkb64, _ := strings.Cut(line, ",")
+		meta := metas[key]
+		if meta.Disabled != 0 || meta.expired(taken.Unix()) {
+			continue
+		}
+		link, err := rei.Atob(linkb64)
+		if err != nil {
+			return fmt.Errorf("decoding link of %s: %w", key, err)
+		}
+		out[key] = snapshotLink{Link: string(link), Expires: meta.Expires}
+	}
+
+	// write it next to the old one first, so a crash doesn't leave half of it.
+	encoded, _ := json.Marshal(snapshotFile{Taken: taken, Links: out}) // can't fail, plain structs
+	if err := os.WriteFile(path+".tmp", encoded, 0o600); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("replacing snapshot: %w", err)
+	}
+	snapshot.set(out, taken)
+	return nil
+}
+
+// watchStore pings the store every storeCheckInterval to know if it's down,
+// and takes the snapshot every snapshotInterval while it's up, forever.
+func watchStore() {
+	check := time.NewTicker(*storeCheckInterval)
+	defer check.Stop()
+	// no snapshot, no point in taking one.
+	var refresh <-chan time.Time
+	if len(*snapshotPath) > 0 && *snapshotInterval > 0 {
+		ticker := time.NewTicker(*snapshotInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+		// the saved one might be old already.
+		if pingStore() == nil {
+			refreshSnapshot()
+		}
+	}
+	for {
+		select {
+		case <-check.C:
+			pingStore()
+		case <-refresh:
+			if !degraded.Load() {
+				refreshSnapshot()
+			}
+		}
+	}
+}
+
+// refreshSnapshot takes the snapshot and logs it if it failed.
+func refreshSnapshot() {
+	if err := takeSnapshot(*snapshotPath); err != nil {
+		log.Printf("taking snapshot: %v", err)
+	}
+}
+
+// pingStore pings the store and enters or leaves the degraded mode.
+func pingStore() error {
+	ctx, cancel := context.WithTimeout(context.Background(), *readyTimeout)
+	defer cancel()
+	err := monomi.ping(ctx)
+	if err != nil && degraded.CompareAndSwap(false, true) {
+		links, taken := snapshot.size()
+		log.Printf("store is down, serving redirects from the snapshot of %d links taken at %s: %v",
+			links, taken.Format(time.RFC3339), err)
+		storeHealth.recordError(fmt.Errorf("entering degraded mode: %w", err))
+		storeDegraded.Set(1)
+	}
+	if err == nil && degraded.CompareAndSwap(true, false) {
+		log.Printf("store is back, serving everything again")
+		storeDegraded.Set(0)
+	}
+	return err
+}
+
+// storeWritable returns StoreUnavailable and an error while the store is down.
+func storeWritable() (MonokumaStatusCode, error) {
+	if degraded.Load() {
+		return StoreUnavailable, errStoreDown
+	}
+	return Success, nil
+}
+
+// retryAfter is the Retry-After header while the store is down, in seconds:
+// the next time it's checked.
+func retryAfter() string {
+	return strconv.Itoa(max(1, int(math.Ceil(storeCheckInterval.Seconds()))))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// downStore is a store that can't be reached.
+type downStore struct {
+	LinkStore
+}
+
+// getLink fails like a store that's down.
+func (downStore) getLink(string) (string, bool, error) {
+	return "", false, errors.New("connection refused")
+}
+
+func TestLinkFromSnapshot(t *testing.T) {
+	useStore(t, downStore{NewMemoryStore()})
+	oldLinks, oldInterval := snapshot.links, storeCheckInterval
+	t.Cleanup(func() {
+		snapshot.links, storeCheckInterval = oldLinks, oldInterval
+		degraded.Store(false)
+	})
+	interval := 5 * time.Second
+	storeCheckInterval = &interval
+	snapshot.links = map[string]snapshotLink{"saved": {Link: "https://example.com/saved"}}
+
+	tests := []struct {
+		name     string
+		degraded bool
+		key      string
+		link     string
+		code     MonokumaStatusCode
+		status   int
+	}{
+		{"in the snapshot", true, "saved", "https://example.com/saved", LinkFound, http.StatusFound},
+		{"not in the snapshot", true, "lost", "", StoreUnavailable, http.StatusServiceUnavailable},
+		{"store failing but up", false, "lost", "", LinkRetrievalError, http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			degraded.Store(test.degraded)
+			link, code, err := operationKeyToLink(test.key)
+			if link != test.link || code != test.code {
+				t.Fatalf("following %s = %q (%s), want %q (%s)", test.key, link, code, test.link, test.code)
+			}
+			if err == nil {
+				return
+			}
+			w := httptest.NewRecorder()
+			writeError(w, httptest.NewRequest(http.MethodGet, "/"+test.key, nil), code, err)
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if retry := w.Header().Get("Retry-After"); (retry == "5") != test.degraded {
+				t.Errorf("Retry-After = %q while degraded %v", retry, test.degraded)
+			}
+		})
+	}
+}
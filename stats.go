@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thecsw/rei"
+)
+
+const (
+	// statClicks is the stats field with the total number of clicks.
+	statClicks = "clicks"
+	// statDayPrefix prefixes the stats fields with the clicks of a day (UTC),
+	// like "day:2025-01-01".
+	statDayPrefix = "day:"
+	// statReferrerPrefix prefixes the stats fields with the clicks from a
+	// referrer host, like "referrer:example.com".
+	statReferrerPrefix = "referrer:"
+	// statAgentPrefix prefixes the stats fields with the clicks from a
+	// user-agent family, like "agent:Firefox".
+	statAgentPrefix = "agent:"
+
+	// The fields above are of human traffic, the fields of other traffic are
+	// prefixed with its class, like "bot:clicks", see statField.
+
+	// noReferrer is the referrer host of clicks without a referrer.
+	noReferrer = "direct"
+
+	// clickQueueSize is how many clicks can wait to be saved before new ones
+	// are dropped.
+	clickQueueSize = 4096
+)
+
+// click is a single followed short link.
+type click struct {
+	// key is the key that was followed.
+	key string
+	// class is the class of traffic, see classifyTraffic.
+	class string
+	// referrer is the host of the referrer, see noReferrer.
+	referrer string
+	// agent is the user-agent family.
+	agent string
+	// ip is the address of the visitor. It's never stored, only its salted
+	// hash is, see visitorHash.
+	ip string
+	// at is when the click happened.
+	at time.Time
+}
+
+// clickQueue has the clicks that weren't saved yet, see writeClicks.
+var clickQueue = make(chan click, clickQueueSize)
+
+// stopClicks stops writeClicks after it saved all the clicks, it closes the
+// given channel when it's done, see flushClicks.
+var stopClicks = make(chan chan struct{})
+
+// linkStats are the clicks of a short link.
+type linkStats struct {
+	// Clicks is the total number of clicks.
+	Clicks int64
+	// Days are the clicks per day, like "2025-01-01".
+	Days map[string]int64
+	// Referrers are the clicks per referrer host.
+	Referrers map[string]int64
+	// Agents are the clicks per user-agent family.
+	Agents map[string]int64
+	// VisitorDays is the (approximate) sum of the unique visitors of every
+	// day, someone visiting on two days is counted twice. Only people are
+	// counted.
+	VisitorDays int64
+	// DailyVisitors are the (approximate) unique visitors per day, nil if
+	// human traffic wasn't asked for.
+	DailyVisitors map[string]int64
+}
+
+// statField returns the stats field of the class of traffic.
+func statField(class, field string) string {
+	if class == trafficHuman {
+		return field
+	}
+	return class + ":" + field
+}
+
+// decodeLinkStats decodes the stored stats fields of the given classes of
+// traffic, adding them up.
+func decodeLinkStats(counts map[string]int64, classes []string) linkStats {
+	stats := linkStats{
+		Days:      map[string]int64{},
+		Referrers: map[string]int64{},
+		Agents:    map[string]int64{},
+	}
+	for field, count := range counts {
+		class := trafficHuman
+		for _, c := range trafficClasses {
+			if c == trafficHuman {
+				continue
+			}
+			if rest, ok := strings.CutPrefix(field, statField(c, "")); ok {
+				class, field = c, rest
+				break
+			}
+		}
+		if !slices.Contains(classes, class) {
+			continue
+		}
+		if field == statClicks {
+			stats.Clicks += count
+		} else if day, ok := strings.CutPrefix(field, statDayPrefix); ok {
+			stats.Days[day] += count
+		} else if referrer, ok := strings.CutPrefix(field, statReferrerPrefix); ok {
+			stats.Referrers[referrer] += count
+		} else if agent, ok := strings.CutPrefix(field, statAgentPrefix); ok {
+			stats.Agents[agent] += count
+		}
+	}
+	return stats
+}
+
+// recordClick queues the click on the key to be saved by writeClicks. It never
+// blocks, so the redirect stays fast. If the queue is full, the click is lost.
+func recordClick(r *http.Request, key string) {
+	select {
+	case clickQueue <- click{
+		key:      key,
+		class:    classifyTraffic(r.UserAgent()),
+		referrer: referrerHost(r.Referer()),
+		agent:    agentFamily(r.UserAgent()),
+		ip:       remoteIP(r),
+		at:       time.Now(),
+	}:
+	default:
+	}
+}
+
+// writeClicks adds up the queued clicks and saves them every interval, until
+// it's stopped through stopClicks.
+func writeClicks(interval time.Duration) {
+	pending := map[string]map[string]int64{}
+	// visitors are the addresses of the visitors of each key on each day.
+	visitors := map[string]map[string]map[string]struct{}{}
+
+	// count adds up the click with the pending ones.
+	count := func(c click) {
+		day := c.at.UTC().Format(time.DateOnly)
+		counts, ok := pending[c.key]
+		if !ok {
+			counts = map[string]int64{}
+			pending[c.key] = counts
+		}
+		counts[statField(c.class, statClicks)]++
+		counts[statField(c.class, statDayPrefix+day)]++
+		counts[statField(c.class, statReferrerPrefix+c.referrer)]++
+		counts[statField(c.class, statAgentPrefix+c.agent)]++
+		// only people are counted as visitors.
+		if c.class != trafficHuman {
+			return
+		}
+		if _, ok := visitors[c.key]; !ok {
+			visitors[c.key] = map[string]map[string]struct{}{}
+		}
+		if _, ok := visitors[c.key][day]; !ok {
+			visitors[c.key][day] = map[string]struct{}{}
+		}
+		visitors[c.key][day][c.ip] = struct{}{}
+	}
+
+	// save saves the pending clicks.
+	save := func() {
+		for key, counts := range pending {
+			if err := monomi.addLinkStats(key, counts); err != nil {
+				log.Printf("saving clicks of %s: %v", key, err)
+			}
+		}
+		for key, days := range visitors {
+			for day, ips := range days {
+				if err := saveVisitors(key, day, ips); err != nil {
+					log.Printf("saving visitors of %s: %v", key, err)
+				}
+			}
+		}
+		pending = map[string]map[string]int64{}
+		visitors = map[string]map[string]map[string]struct{}{}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case c := <-clickQueue:
+			count(c)
+		case <-ticker.C:
+			save()
+		case done := <-stopClicks:
+			// the clicks still in the queue are saved too.
+			for len(clickQueue) > 0 {
+				count(<-clickQueue)
+			}
+			save()
+			close(done)
+			return
+		}
+	}
+}
+
+// flushClicks saves the clicks that weren't saved yet and stops writeClicks.
+// It gives up when the context is done.
+func flushClicks(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case stopClicks <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// oldestSaltDay returns the oldest day whose visitor salt is kept by now,
+// yesterday, as the late clicks of the day that just ended still need it.
+func oldestSaltDay(now time.Time) string {
+	return now.UTC().AddDate(0, 0, -1).Format(time.DateOnly)
+}
+
+// daySalt is the last salt of the visitors' hashes we've seen, so we don't
+// ask the store for it every time. Only writeClicks uses it.
+var daySalt struct{ day, salt string }
+
+// saveVisitors hashes the addresses of the key's visitors on the day and
+// saves the hashes.
+func saveVisitors(key, day string, ips map[string]struct{}) error {
+	if daySalt.day != day {
+		fresh := make([]byte, 16)
+		if _, err := rand.Read(fresh); err != nil {
+			return fmt.Errorf("generating visitor salt: %w", err)
+		}
+		salt, err := monomi.visitorSalt(day, hex.EncodeToString(fresh))
+		if err != nil {
+			return fmt.Errorf("getting visitor salt: %w", err)
+		}
+		daySalt.day, daySalt.salt = day, salt
+	}
+	hashes := make([]string, 0, len(ips))
+	for ip := range ips {
+		hashes = append(hashes, rei.Sha256([]byte(daySalt.salt+ip)))
+	}
+	return monomi.addLinkVisitors(key, day, hashes)
+}
+
+// remoteIP returns the address of the client, without the port. The real
+// address is already there if the request came through a proxy, see
+// middleware.RealIP.
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// referrerHost returns the host of the referrer, noReferrer if there is none.
+func referrerHost(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil || len(u.Hostname()) < 1 {
+		return noReferrer
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// agentFamilies are the user-agent families by the token that gives them away.
+// The order matters, as most browsers pretend to be the ones before them.
+var agentFamilies = []struct{ token, family string }{
+	{"bot", "Bot"},
+	{"spider", "Bot"},
+	{"crawl", "Bot"},
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+	{"edg/", "Edge"},
+	{"edga/", "Edge"},
+	{"edgios/", "Edge"},
+	{"opr/", "Opera"},
+	{"firefox/", "Firefox"},
+	{"chrome/", "Chrome"},
+	{"crios/", "Chrome"},
+	{"safari/", "Safari"},
+}
+
+// agentFamily returns the family of the user-agent, like "Firefox".
+func agentFamily(agent string) string {
+	agent = strings.ToLower(agent)
+	if len(agent) < 1 {
+		return "Unknown"
+	}
+	for _, f := range agentFamilies {
+		if strings.Contains(agent, f.token) {
+			return f.family
+		}
+	}
+	return "Other"
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// storeRedis is the name of the redis storage backend.
+	storeRedis = "redis"
+	// storeMemory is the name of the in-memory storage backend.
+	storeMemory = "memory"
+	// storeBolt is the name of the embedded bolt (single file) storage backend.
+	storeBolt = "bolt"
+
+	// customKeyMaxLength is the max number of characters in a custom key. Arbitrarily chosen.
+	customKeyMaxLength = 37
+)
+
+var (
+	// storeTables are all the tables a store keeps.
+	storeTables = []string{keyToLinkTable, linkExistsTable, linkMetaTable, linkHistoryTable, visitorSaltTable,
+		apiTokensTable, apiTokensUsedTable, creationLimitsTable}
+
+	// storeBackend is the name of the storage backend to use.
+	storeBackend *string
+
+	// maxNumGenTries is the maximum number of times to try to generate a unique key.
+	maxNumGenTries *int
+
+	// alwaysAlias is whether to create a new key (an alias) for links that are
+	// already shortened instead of returning their existing key.
+	alwaysAlias *bool
+
+	// reservedKeys are the paths of the routes next to /{key}, links under
+	// them could never be followed.
+	reservedKeys = []string{"create", "export", "healthz", "metrics", "readyz"}
+)
+
+var (
+	// errKeyExists is returned when a key already exists
+	errKeyExists = errors.New("key already exists")
+	// errKeyTooLong is returned when a custom key is longer than customKeyMaxLength.
+	errKeyTooLong = errors.New("key is too long")
+	// errKeyInvalid is returned when a custom key doesn't match keyRegexp, or
+	// is one of reservedKeys.
+	errKeyInvalid = errors.New("key is invalid")
+	// errKeyspaceExhausted is returned when no unique key could be generated.
+	errKeyspaceExhausted = errors.New("keyspace is exhausted")
+)
+
+// LinkStore is the storage behind monokuma. It keeps two tables: one that maps
+// keys to links (keyToLinkTable) and one that maps links' hashes to the set of
+// keys shortening them (linkExistsTable), so that the same link is either
+// never shortened twice or all of its aliases are known.
+type LinkStore interface {
+	// writeLink writes a new link with its metadata to the store. If
+	// customKey is provided, it will be used as the key. Otherwise, a new key
+	// will be generated. Expired keys are free to be claimed again. If the
+	// link is already shortened, its existing key is returned as deduped,
+	// unless alias is set, then the new key is added as another alias.
+	writeLink(linkb64, customKey string, meta linkMeta, alias bool) (key string, deduped bool, err error)
+	// getLink returns the link for the given key. If the key does not exist,
+	// it returns an empty string, false, and nil error.
+	getLink(key string) (link string, found bool, err error)
+	// exportLinks returns all the links in the store in the format: key,link
+	exportLinks() ([]string, error)
+	// exportLinkMeta returns the metadata of all the links in the store by key.
+	exportLinkMeta() (map[string]linkMeta, error)
+	// keyExists returns true if the given key exists in the given table.
+	keyExists(table, key string) (bool, error)
+	// isLinkAlreadyShortened checks if the link is already shortened and
+	// returns its hash and all of its keys if so.
+	isLinkAlreadyShortened(linkb64 string) (hash string, keys []string, exists bool, err error)
+	// updateLink points the key to a new link, moving the key to the new
+	// link's hash and saving the old link in the key's history. It returns
+	// false if the key does not exist.
+	updateLink(key, linkb64 string) (found bool, err error)
+	// getLinkHistory returns the links the key pointed to before, oldest first.
+	getLinkHistory(key string) ([]linkHistoryEntry, error)
+	// deleteLink removes the key, its place in its link's hash, its metadata,
+	// its history, and its stats from the store. It returns false if the key
+	// did not exist.
+	deleteLink(key string) (found bool, err error)
+	// deleteExpiredLink is deleteLink, but only if the key has expired by now.
+	deleteExpiredLink(key string, now int64) (found bool, err error)
+	// expiredKeys returns the keys that have expired by now.
+	expiredKeys(now int64) ([]string, error)
+	// getLinkMeta returns the metadata of the key, empty if there is none.
+	getLinkMeta(key string) (linkMeta, error)
+	// setLinkMeta saves the metadata of the key. It returns false if the key
+	// does not exist.
+	setLinkMeta(key string, meta linkMeta) (found bool, err error)
+	// addLinkStats adds the counts to the key's stats fields. Counts of keys
+	// that don't exist (anymore) are dropped.
+	addLinkStats(key string, counts map[string]int64) error
+	// getLinkStats returns the key's stats fields, empty if there are none.
+	getLinkStats(key string) (map[string]int64, error)
+	// addLinkVisitors adds the hashed visitors of the day to the key's
+	// visitors of the day and of all time. The hashes are salted per day, so
+	// the ones of all time are visitor days, see countLinkVisitors. Visitors
+	// of keys that don't exist (anymore) are dropped.
+	addLinkVisitors(key, day string, visitors []string) error
+	// countLinkVisitors returns the (approximate) number of the key's visitor
+	// days, the sum of its unique visitors of every day, and its unique
+	// visitors of each of the given days.
+	countLinkVisitors(key string, days []string) (visitorDays int64, daily map[string]int64, err error)
+	// visitorSalt returns the salt of the visitors' hashes on the day. If
+	// the day has no salt yet, fresh becomes its salt. Salts of the days
+	// before oldestSaltDay are forgotten, so visitors can't be followed
+	// across days.
+	visitorSalt(day, fresh string) (string, error)
+	// createToken saves the new API token under the name. It returns
+	// errTokenExists if there's already a token with the name.
+	createToken(name string, token apiToken) error
+	// getToken returns the API token with the name. If there's none, it
+	// returns an empty token, false, and nil error.
+	getToken(name string) (token apiToken, found bool, err error)
+	// listTokens returns all the API tokens by name.
+	listTokens() (map[string]apiToken, error)
+	// deleteToken removes the API token with the name. It returns false if
+	// there was none.
+	deleteToken(name string) (found bool, err error)
+	// touchToken saves that the API token was last used now. Tokens that
+	// don't exist (anymore) are ignored.
+	touchToken(name string, now int64) error
+	// takeCreation counts a link creation of the API token now, if the limits
+	// allow it. It returns the token's counter after it and whether they did.
+	takeCreation(name string, limits createLimits, now time.Time) (counter creationCounter, allowed bool, err error)
+	// refundCreation gives back the quotas of a creation of the API token
+	// taken now that didn't create a new link, see creationCounter.refund.
+	refundCreation(name string, now time.Time) error
+	// ping checks that the store answers.
+	ping(ctx context.Context) error
+	// Close closes the store.
+	Close()
+}
+
+// linkMeta is the bookkeeping kept next to each link in linkMetaTable.
+type linkMeta struct {
+	// Created is the unix time when the link was created, 0 if unknown.
+	Created int64 `json:"created,omitempty"`
+	// Disabled is the unix time when the link was disabled, 0 if it's enabled.
+	Disabled int64 `json:"disabled,omitempty"`
+	// Expires is the unix time when the link expires, 0 if it never does.
+	Expires int64 `json:"expires,omitempty"`
+	// CreatedBy is the name of the API token that created the link, empty if
+	// unknown or there was no auth.
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// expired returns true if the link has expired by now.
+func (meta linkMeta) expired(now int64) bool {
+	return meta.Expires != 0 && meta.Expires <= now
+}
+
+// followable returns true if the link can be followed by now, it's neither
+// disabled nor expired.
+func (meta linkMeta) followable(now int64) bool {
+	return meta.Disabled == 0 && !meta.expired(now)
+}
+
+// encodeLinkMeta encodes the link metadata for storing.
+func encodeLinkMeta(meta linkMeta) string {
+	encoded, _ := json.Marshal(meta) // can't fail, it's a plain struct
+	return string(encoded)
+}
+
+// decodeLinkMeta decodes the stored link metadata, empty string is no metadata.
+func decodeLinkMeta(encoded string) (meta linkMeta, err error) {
+	if len(encoded) < 1 {
+		return
+	}
+	if err = json.Unmarshal([]byte(encoded), &meta); err != nil {
+		err = fmt.Errorf("decoding link metadata ('%s'): %w", encoded, err)
+	}
+	return
+}
+
+// decodeLinkMetas decodes the stored metadata of many keys.
+func decodeLinkMetas(encoded map[string]string) (map[string]linkMeta, error) {
+	metas := make(map[string]linkMeta, len(encoded))
+	for key, value := range encoded {
+		meta, err := decodeLinkMeta(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", key, err)
+		}
+		metas[key] = meta
+	}
+	return metas, nil
+}
+
+// linkHistoryEntry is a link that a key pointed to before it was updated.
+type linkHistoryEntry struct {
+	// Replaced is the unix time when the link was replaced.
+	Replaced int64
+	// Link is the replaced link in base64.
+	Link string
+}
+
+// encodeLinkHistoryEntry encodes a history entry as a "replaced,link" line,
+// so entries can be appended to the key's history.
+func encodeLinkHistoryEntry(entry linkHistoryEntry) string {
+	return strconv.FormatInt(entry.Replaced, 10) + "," + entry.Link + "\n"
+}
+
+// decodeLinkHistory decodes the stored history lines of a key.
+func decodeLinkHistory(encoded string) ([]linkHistoryEntry, error) {
+	lines := strings.Split(strings.TrimSpace(encoded), "\n")
+	history := make([]linkHistoryEntry, 0, len(lines))
+	for _, line := range lines {
+		if len(line) < 1 {
+			continue
+		}
+		replaced, link, ok := strings.Cut(line, ",")
+		if !ok {
+			return nil, fmt.Errorf("bad history line ('%s')", line)
+		}
+		unix, err := strconv.ParseInt(replaced, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad history time ('%s'): %w", line, err)
+		}
+		history = append(history, linkHistoryEntry{Replaced: unix, Link: link})
+	}
+	return history, nil
+}
+
+// splitKeys splits the set of keys a link's hash maps to in linkExistsTable.
+// The set is stored as comma-separated keys, keys can't have commas in them.
+func splitKeys(set string) []string {
+	if len(set) < 1 {
+		return nil
+	}
+	return strings.Split(set, ",")
+}
+
+// addKey adds the key to the set of keys, if it's not there already.
+func addKey(set, key string) string {
+	if len(set) < 1 {
+		return key
+	}
+	if slices.Contains(splitKeys(set), key) {
+		return set
+	}
+	return set + "," + key
+}
+
+// removeKey removes the key from the set of keys, empty if none are left.
+func removeKey(set, key string) string {
+	return strings.Join(slices.DeleteFunc(splitKeys(set), func(k string) bool {
+		return k == key
+	}), ",")
+}
+
+// linkStatsTable is the name of the table with the stats of the key.
+func linkStatsTable(key string) string {
+	return linkStatsPrefix + key
+}
+
+// linkVisitorsTable is the name of the table with the visitors of the key on
+// the day, or of all time (the visitor days) if day is empty.
+func linkVisitorsTable(key, day string) string {
+	if len(day) < 1 {
+		return linkVisitorsPrefix + key
+	}
+	return linkVisitorsPrefix + key + ":" + day
+}
+
+// statsDays returns the days the stats fields have clicks on.
+func statsDays(fields []string) []string {
+	days := []string{}
+	for _, field := range fields {
+		if day, ok := strings.CutPrefix(field, statDayPrefix); ok {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// decodeStatsFields decodes the stored counts of the stats fields.
+func decodeStatsFields(fields map[string]string) (map[string]int64, error) {
+	counts := make(map[string]int64, len(fields))
+	for field, count := range fields {
+		n, err := strconv.ParseInt(count, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad stats count ('%s'='%s'): %w", field, count, err)
+		}
+		counts[field] = n
+	}
+	return counts, nil
+}
+
+// NewLinkStore creates the storage backend chosen by storeBackend.
+func NewLinkStore() LinkStore {
+	switch *storeBackend {
+	case storeRedis:
+		return NewDangan()
+	case storeMemory:
+		return NewMemoryStore()
+	case storeBolt:
+		return NewBoltStore(*storePath)
+	}
+	fmt.Printf("unknown store '%s', must be one of: %s, %s, %s\n",
+		*storeBackend, storeRedis, storeMemory, storeBolt)
+	os.Exit(1)
+	return nil
+}
+
+// getUniqueKey claims a unique key for a link. claim must atomically check
+// that the key is free and save the link under it, returning errKeyExists if
+// the key is taken, or the existing key and deduped if the link is already
+// shortened. If customKey is provided, it will be the only key tried.
+// Otherwise, new keys will be generated until one of them is claimed.
+func getUniqueKey(
+	claim func(key string) (owner string, deduped bool, err error), customKey string,
+) (string, bool, error) {
+	// First, let's check if the custom key is provided and try to claim it
+	if len(customKey) > 0 {
+		// see if it's too long
+		if len(customKey) > customKeyMaxLength {
+			return "", false, fmt.Errorf("custom key is too long, max size is %d: %w",
+				customKeyMaxLength, errKeyTooLong)
+		}
+		// Check the key against the regular expression.
+		if !keyRegexp.MatchString(customKey) {
+			return "", false, fmt.Errorf("key %s is invalid, needs to match %s: %w",
+				customKey, keyRegexpPattern, errKeyInvalid)
+		}
+		if slices.Contains(reservedKeys, customKey) {
+			return "", false, fmt.Errorf("key %s is reserved for a route: %w", customKey, errKeyInvalid)
+		}
+		// move on
+		key, deduped, err := claim(customKey)
+		// if it exists, send an error
+		if errors.Is(err, errKeyExists) {
+			return "", false, fmt.Errorf("custom key already exists: %w", errKeyExists)
+		}
+		// some generic error
+		if err != nil {
+			return "", false, fmt.Errorf("claiming custom key ('%s'): %w", customKey, err)
+		}
+		return key, deduped, nil
+	}
+	// Now, let's try generate the key until we claim a unique one or we reach the
+	// maximum number of tries (maxNumGenTries).
+	tries := setting(maxNumGenTries)
+	for i := 0; i < tries; i++ {
+		key := gen()
+		// like it's taken, by a route.
+		if slices.Contains(reservedKeys, key) {
+			keyGenerationRetries.Inc()
+			continue
+		}
+		key, deduped, err := claim(key)
+		// try again
+		if errors.Is(err, errKeyExists) {
+			keyGenerationRetries.Inc()
+			continue
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("claiming generated key #%d: %w", i+1, err)
+		}
+		return key, deduped, nil
+	}
+	// We failed to generate a unique key after maxNumGenTries--sad
+	keyspaceExhausted.Inc()
+	return "", false, fmt.Errorf("couldn't generate a unique key after %d tries: %w",
+		tries, errKeyspaceExhausted)
+}
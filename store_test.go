@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thecsw/rei"
+)
+
+// storeTest is a test of the behaviour every LinkStore has to have.
+type storeTest struct {
+	name string
+	run  func(t *testing.T)
+}
+
+// storeTests are run against every store by testStore.
+var storeTests = []storeTest{
+	{"create", testStoreCreate},
+	{"custom keys", testStoreCustomKeys},
+	{"disable", testStoreDisable},
+	{"expire", testStoreExpire},
+	{"update", testStoreUpdate},
+	{"delete", testStoreDelete},
+	{"concurrent creations", testStoreConcurrentCreate},
+	{"creation limits", testStoreCreationLimits},
+	{"visitors", testStoreVisitors},
+}
+
+// testStore runs storeTests against the stores open returns, a new empty one
+// for every test.
+func testStore(t *testing.T, open func(t *testing.T) LinkStore) {
+	for _, test := range storeTests {
+		t.Run(test.name, func(t *testing.T) {
+			useStore(t, open(t))
+			test.run(t)
+		})
+	}
+}
+
+// useStore makes monomi the store with the default settings for the test,
+// and puts everything back after it.
+func useStore(t *testing.T, store LinkStore) {
+	t.Helper()
+	oldStore := monomi
+	oldAlias, oldTTL, oldTries := alwaysAlias, cacheTTL, maxNumGenTries
+	oldAlphabet, oldSize, oldBlocked := alphabet, keysize, blockedHosts
+	t.Cleanup(func() {
+		store.Close()
+		monomi = oldStore
+		alwaysAlias, cacheTTL, maxNumGenTries = oldAlias, oldTTL, oldTries
+		alphabet, keysize, blockedHosts = oldAlphabet, oldSize, oldBlocked
+		keyToUrl.Flush()
+	})
+
+	aliases, ttl, tries := false, time.Hour, 100
+	letters, size := "abcdefghijklmnopqrstuvwxyz", 5
+	alwaysAlias, cacheTTL, maxNumGenTries = &aliases, &ttl, &tries
+	alphabet, keysize, blockedHosts = &letters, &size, nil
+	monomi = store
+	keyToUrl.Flush()
+}
+
+// create shortens the link and fails the test if it can't.
+func create(t *testing.T, link string, opts createOptions) linkInfo {
+	t.Helper()
+	info, code, err := operationCreateLink(strings.NewReader(link), opts)
+	if err != nil || code != Success {
+		t.Fatalf("creating %s: %v (%s)", link, err, code)
+	}
+	return info
+}
+
+// follow checks that the key leads to the link with the code.
+func follow(t *testing.T, key, link string, code MonokumaStatusCode) {
+	t.Helper()
+	got, gotCode, _ := operationKeyToLink(key)
+	if got != link || gotCode != code {
+		t.Errorf("following %s = %q (%s), want %q (%s)", key, got, gotCode, link, code)
+	}
+}
+
+func testStoreCreate(t *testing.T) {
+	const link = "https://example.com/a"
+
+	first := create(t, link, createOptions{})
+	if first.Deduped || len(first.Key) != 5 {
+		t.Errorf("first creation = %+v, want a new key of 5 letters", first)
+	}
+	follow(t, first.Key, link, LinkFound)
+
+	again := create(t, link, createOptions{})
+	if !again.Deduped || again.Key != first.Key {
+		t.Errorf("second creation = %+v, want %s deduped", again, first.Key)
+	}
+
+	alias := create(t, link, createOptions{alias: "true"})
+	if alias.Deduped || alias.Key == first.Key {
+		t.Errorf("alias creation = %+v, want a new key", alias)
+	}
+	follow(t, alias.Key, link, LinkFound)
+
+	follow(t, "nothere", "", LinkNotFound)
+}
+
+func testStoreCustomKeys(t *testing.T) {
+	custom := create(t, "https://example.com/b", createOptions{customKey: "my-key"})
+	if custom.Key != "my-key" {
+		t.Errorf("custom key = %s, want my-key", custom.Key)
+	}
+	follow(t, "my-key", "https://example.com/b", LinkFound)
+
+	tests := []struct {
+		key  string
+		code MonokumaStatusCode
+	}{
+		{"my-key", KeyTaken},
+		{"metrics", BadKey},
+		{"healthz", BadKey},
+		{"no", BadKey},
+		{"no/slashes", BadKey},
+		{strings.Repeat("k", customKeyMaxLength+1), KeyTooLong},
+	}
+	for _, test := range tests {
+		_, code, err := operationCreateLink(strings.NewReader("https://example.com/c"),
+			createOptions{customKey: test.key})
+		if err == nil || code != test.code {
+			t.Errorf("creating with key %s = %v (%s), want %s", test.key, err, code, test.code)
+		}
+	}
+}
+
+func testStoreDisable(t *testing.T) {
+	const link = "https://example.com/d"
+
+	first := create(t, link, createOptions{})
+	follow(t, first.Key, link, LinkFound)
+	if code, err := operationSetLinkDisabled(first.Key, true); err != nil {
+		t.Fatalf("disabling %s: %v (%s)", first.Key, err, code)
+	}
+	follow(t, first.Key, "", LinkGone)
+
+	// the disabled key isn't handed out again.
+	second := create(t, link, createOptions{})
+	if second.Deduped || second.Key == first.Key {
+		t.Errorf("creation after disabling = %+v, want a new key", second)
+	}
+	follow(t, second.Key, link, LinkFound)
+
+	if code, err := operationSetLinkDisabled(first.Key, false); err != nil {
+		t.Fatalf("enabling %s: %v (%s)", first.Key, err, code)
+	}
+	follow(t, first.Key, link, LinkFound)
+
+	if code, _ := operationSetLinkDisabled("nothere", true); code != LinkNotFound {
+		t.Errorf("disabling a missing key = %s, want %s", code, LinkNotFound)
+	}
+}
+
+func testStoreExpire(t *testing.T) {
+	const link = "https://example.com/e"
+
+	past := time.Now().Add(-time.Minute).Unix()
+	meta := linkMeta{Created: past - 60, Expires: past}
+	if _, _, err := monomi.writeLink(rei.Btao([]byte(link)), "old-key", meta, false); err != nil {
+		t.Fatal(err)
+	}
+	follow(t, "old-key", "", LinkGone)
+
+	// the expired key isn't handed out again.
+	fresh := create(t, link, createOptions{})
+	if fresh.Deduped || fresh.Key == "old-key" {
+		t.Errorf("creation after expiry = %+v, want a new key", fresh)
+	}
+	follow(t, fresh.Key, link, LinkFound)
+
+	// and it can be claimed by another link.
+	reused := create(t, "https://example.com/f", createOptions{customKey: "old-key"})
+	if reused.Key != "old-key" {
+		t.Errorf("claiming the expired key = %+v, want old-key", reused)
+	}
+	follow(t, "old-key", "https://example.com/f", LinkFound)
+
+	// a link with a ttl is followed until then.
+	ttl := create(t, "https://example.com/g", createOptions{ttl: "1h"})
+	if ttl.Meta.Expires <= time.Now().Unix() {
+		t.Errorf("link with a ttl expires at %d, want in the future", ttl.Meta.Expires)
+	}
+	follow(t, ttl.Key, "https://example.com/g", LinkFound)
+}
+
+func testStoreUpdate(t *testing.T) {
+	const before, after = "https://example.com/before", "https://example.com/after"
+
+	info := create(t, before, createOptions{})
+	follow(t, info.Key, before, LinkFound)
+	if code, err := operationUpdateLink(info.Key, strings.NewReader(after)); err != nil {
+		t.Fatalf("updating %s: %v (%s)", info.Key, err, code)
+	}
+	follow(t, info.Key, after, LinkFound)
+
+	// the key moved to the hash of the new link.
+	if again := create(t, after, createOptions{}); !again.Deduped || again.Key != info.Key {
+		t.Errorf("creating the new link = %+v, want %s deduped", again, info.Key)
+	}
+	if old := create(t, before, createOptions{}); old.Deduped || old.Key == info.Key {
+		t.Errorf("creating the old link = %+v, want a new key", old)
+	}
+
+	history, _, err := operationGetLinkHistory(info.Key)
+	if err != nil || len(history) != 1 || history[0].Link != rei.Btao([]byte(before)) {
+		t.Errorf("history of %s = %+v, %v, want the old link", info.Key, history, err)
+	}
+
+	if code, err := operationRevertLink(info.Key); err != nil {
+		t.Fatalf("reverting %s: %v (%s)", info.Key, err, code)
+	}
+	follow(t, info.Key, before, LinkFound)
+
+	if code, _ := operationUpdateLink("nothere", strings.NewReader(after)); code != LinkNotFound {
+		t.Errorf("updating a missing key = %s, want %s", code, LinkNotFound)
+	}
+}
+
+func testStoreDelete(t *testing.T) {
+	const link = "https://example.com/deleted"
+
+	first := create(t, link, createOptions{})
+	alias := create(t, link, createOptions{alias: "true"})
+	if code, err := operationDeleteLink(first.Key); err != nil {
+		t.Fatalf("deleting %s: %v (%s)", first.Key, err, code)
+	}
+	follow(t, first.Key, "", LinkNotFound)
+	if code, _ := operationDeleteLink(first.Key); code != LinkNotFound {
+		t.Errorf("deleting %s again = %s, want %s", first.Key, code, LinkNotFound)
+	}
+
+	// the alias is left, and the link's hash is only its now.
+	follow(t, alias.Key, link, LinkFound)
+	if again := create(t, link, createOptions{}); !again.Deduped || again.Key != alias.Key {
+		t.Errorf("creation after deleting = %+v, want %s deduped", again, alias.Key)
+	}
+	_, keys, _, err := monomi.isLinkAlreadyShortened(rei.Btao([]byte(link)))
+	if err != nil || len(keys) != 1 || keys[0] != alias.Key {
+		t.Errorf("keys of the link = %v, %v, want only %s", keys, err, alias.Key)
+	}
+
+	// only expired keys are swept.
+	now := time.Now().Unix()
+	if found, err := monomi.deleteExpiredLink(alias.Key, now); found || err != nil {
+		t.Errorf("sweeping %s = %v, %v, want it kept", alias.Key, found, err)
+	}
+	meta := linkMeta{Created: now - 60, Expires: now - 1}
+	if _, _, err := monomi.writeLink(rei.Btao([]byte("https://example.com/swept")), "swept", meta, false); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := monomi.deleteExpiredLink("swept", now); !found || err != nil {
+		t.Errorf("sweeping swept = %v, %v, want it gone", found, err)
+	}
+	if _, found, _ := monomi.getLink("swept"); found {
+		t.Error("swept is still there after sweeping it")
+	}
+}
+
+func testStoreConcurrentCreate(t *testing.T) {
+	const creators = 20
+
+	// all of them get the same key, only one of them a new one.
+	infos := make([]linkInfo, creators)
+	var wg sync.WaitGroup
+	for i := range infos {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			infos[i], _, _ = operationCreateLink(strings.NewReader("https://example.com/race"), createOptions{})
+		}()
+	}
+	wg.Wait()
+	created := 0
+	for _, info := range infos {
+		if info.Key != infos[0].Key || len(info.Key) < 1 {
+			t.Fatalf("racing creations got keys %s and %s", infos[0].Key, info.Key)
+		}
+		if !info.Deduped {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("racing creations created %d keys, want 1", created)
+	}
+
+	// only one of them claims the custom key.
+	codes := make([]MonokumaStatusCode, creators)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			link := strings.NewReader(fmt.Sprintf("https://example.com/race/%d", i))
+			_, codes[i], _ = operationCreateLink(link, createOptions{customKey: "raced"})
+		}()
+	}
+	wg.Wait()
+	claimed := 0
+	for _, code := range codes {
+		switch code {
+		case Success:
+			claimed++
+		case KeyTaken:
+		default:
+			t.Errorf("racing for a custom key = %s, want %s or %s", code, Success, KeyTaken)
+		}
+	}
+	if claimed != 1 {
+		t.Errorf("racing for a custom key claimed it %d times, want 1", claimed)
+	}
+	link, _, _ := monomi.getLink("raced")
+	_, keys, _, _ := monomi.isLinkAlreadyShortened(link)
+	if len(keys) != 1 || keys[0] != "raced" {
+		t.Errorf("keys of the link of raced = %v, want only raced", keys)
+	}
+}
+
+func testStoreCreationLimits(t *testing.T) {
+	limits := createLimits{Rate: 60, Burst: 3, Daily: 4, Monthly: 5}
+	steps := []struct {
+		after   time.Duration
+		refund  bool
+		allowed bool
+	}{
+		{0, false, true},
+		{0, false, true},
+		{0, false, true},
+		// the burst is used up.
+		{0, false, false},
+		{time.Second, false, true},
+		// the bucket is full again, but the daily quota is used up.
+		{2 * time.Minute, false, false},
+		{2 * time.Minute, true, false},
+		{2 * time.Minute, false, true},
+		{24 * time.Hour, false, true},
+		// the monthly quota is used up.
+		{24*time.Hour + time.Minute, false, false},
+	}
+	want := creationCounter{At: -1}
+	for i, step := range steps {
+		now := testNow.Add(step.after)
+		if step.refund {
+			want.refund(now)
+			if err := monomi.refundCreation("ci", now); err != nil {
+				t.Fatalf("step %d: refunding: %v", i, err)
+			}
+			continue
+		}
+		wantAllowed := want.take(limits, now)
+		counter, allowed, err := monomi.takeCreation("ci", limits, now)
+		if err != nil {
+			t.Fatalf("step %d: taking: %v", i, err)
+		}
+		if allowed != step.allowed || allowed != wantAllowed {
+			t.Errorf("step %d: allowed = %v, want %v", i, allowed, step.allowed)
+		}
+		if counter != want {
+			t.Errorf("step %d: counter = %+v, want %+v", i, counter, want)
+		}
+	}
+
+	// refunds of tokens that never created anything are dropped.
+	if err := monomi.refundCreation("nobody", testNow); err != nil {
+		t.Errorf("refunding a token without creations: %v", err)
+	}
+
+	// a deleted token starts over.
+	if err := monomi.createToken("ci", apiToken{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := monomi.deleteToken("ci"); err != nil {
+		t.Fatal(err)
+	}
+	counter, allowed, err := monomi.takeCreation("ci", limits, testNow.Add(24*time.Hour+time.Minute))
+	if err != nil || !allowed || counter.Monthly != 1 {
+		t.Errorf("taking after deleting the token = %+v, %v, %v, want a new counter", counter, allowed, err)
+	}
+}
+
+func testStoreVisitors(t *testing.T) {
+	daySalt.day, daySalt.salt = "", ""
+	t.Cleanup(func() { daySalt.day, daySalt.salt = "", "" })
+
+	info := create(t, "https://example.com/visited", createOptions{})
+	now := time.Now().UTC()
+	yesterday, today := now.AddDate(0, 0, -1).Format(time.DateOnly), now.Format(time.DateOnly)
+	visits := []struct {
+		day string
+		ips []string
+	}{
+		{yesterday, []string{"192.0.2.1", "192.0.2.2"}},
+		{today, []string{"192.0.2.1"}},
+		// a later batch of the same day.
+		{today, []string{"192.0.2.1", "192.0.2.3"}},
+	}
+	for _, visit := range visits {
+		ips := map[string]struct{}{}
+		for _, ip := range visit.ips {
+			ips[ip] = struct{}{}
+		}
+		if err := saveVisitors(info.Key, visit.day, ips); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// visitors of keys that don't exist are dropped.
+	if err := saveVisitors("nothere", today, map[string]struct{}{"192.0.2.9": {}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 192.0.2.1 came on both days, so it's two visitor days.
+	visitorDays, daily, err := monomi.countLinkVisitors(info.Key, []string{yesterday, today})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if visitorDays != 4 || daily[yesterday] != 2 || daily[today] != 2 {
+		t.Errorf("visitors = %d, %v, want 4 visitor days and 2 a day", visitorDays, daily)
+	}
+	if visitorDays, _, _ := monomi.countLinkVisitors("nothere", nil); visitorDays != 0 {
+		t.Errorf("visitor days of a missing key = %d, want 0", visitorDays)
+	}
+}
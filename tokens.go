@@ -0,0 +1,336 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thecsw/rei"
+)
+
+const (
+	// apiTokensTable is the name of the table that maps the names of the API
+	// tokens to the tokens, see apiToken.
+	apiTokensTable = "apitokens"
+	// apiTokensUsedTable is the name of the table that maps the names of the
+	// API tokens to when they were last used.
+	apiTokensUsedTable = "apitokensused"
+
+	// scopeCreate lets the token create links.
+	scopeCreate = "create"
+	// scopeUpdate lets the token point links somewhere else and revert them,
+	// any of them, not only the ones it created.
+	scopeUpdate = "update"
+	// scopeExport lets the token list links and see them and their history.
+	scopeExport = "export"
+	// scopeDelete lets the token delete, disable, and enable links.
+	scopeDelete = "delete"
+	// scopeStats lets the token see the clicks of the links and the metrics.
+	scopeStats = "stats"
+	// scopeAdmin lets the token do everything.
+	scopeAdmin = "admin"
+
+	// legacyTokenName is the name of the -auth token, it has every scope.
+	legacyTokenName = "auth"
+
+	// tokenTouchInterval is how often at most the last use of a token is
+	// saved, so every request doesn't write to the store.
+	tokenTouchInterval = time.Minute
+)
+
+var (
+	// auth is the legacy token the API takes in the Authorization header (as
+	// "Bearer token") with every scope, empty for none.
+	auth *string
+	// noAuth is whether the API is served without any token.
+	noAuth *bool
+
+	// tokenCreate is the name of the token to create and exit, empty for none.
+	tokenCreate *string
+	// tokenScopes are the comma-separated scopes of the created token.
+	tokenScopes *string
+	// tokenCreateLimits are the limits of the created token over the
+	// server's, see parseTokenLimits.
+	tokenCreateLimits *string
+	// tokenRevoke is the name of the token to revoke and exit, empty for none.
+	tokenRevoke *string
+	// tokenList is whether to list the tokens and exit.
+	tokenList *bool
+)
+
+var (
+	// tokenScopeNames are all the scopes, see scopeCreate and friends.
+	tokenScopeNames = []string{scopeCreate, scopeUpdate, scopeExport, scopeDelete, scopeStats, scopeAdmin}
+
+	// tokenNameRegexp is the regular expression for a token name, no dots, as
+	// the name and the secret are separated by one.
+	tokenNameRegexp = regexp.MustCompile(`^[-_0-9a-zA-Z]{1,64}$`)
+
+	// touchedTokens maps the names of the tokens to the unix time their last
+	// use was saved, see tokenTouchInterval.
+	touchedTokens sync.Map
+)
+
+var (
+	// errTokenExists is returned when a token with the name already exists.
+	errTokenExists = errors.New("token already exists")
+	// errUnauthorized is returned when the request has no valid token.
+	errUnauthorized = errors.New("unauthorized")
+)
+
+// apiToken is an API token as kept in apiTokensTable. The secret itself is
+// never kept, only its hash.
+type apiToken struct {
+	// Hash is the SHA-256 of the secret, in hex.
+	Hash string `json:"hash"`
+	// Scopes are what the token is allowed to do.
+	Scopes []string `json:"scopes"`
+	// Created is the unix time when the token was created.
+	Created int64 `json:"created"`
+	// Limits are the limits of the links the token can create that aren't
+	// the server's.
+	Limits tokenLimits `json:"limits"`
+	// LastUsed is the unix time when the token was last used, 0 if never. It's
+	// kept in apiTokensUsedTable, see tokenTouchInterval.
+	LastUsed int64 `json:"-"`
+}
+
+// allows returns true if the token has the scope, or is an admin.
+func (token apiToken) allows(scope string) bool {
+	return slices.Contains(token.Scopes, scope) || slices.Contains(token.Scopes, scopeAdmin)
+}
+
+// encodeApiToken encodes the token for storing.
+func encodeApiToken(token apiToken) string {
+	encoded, _ := json.Marshal(token) // can't fail, it's a plain struct
+	return string(encoded)
+}
+
+// decodeApiToken decodes the stored token and when it was last used, empty
+// string is never.
+func decodeApiToken(encoded, lastUsed string) (token apiToken, err error) {
+	if err = json.Unmarshal([]byte(encoded), &token); err != nil {
+		return token, fmt.Errorf("decoding token ('%s'): %w", encoded, err)
+	}
+	if len(lastUsed) > 0 {
+		if token.LastUsed, err = strconv.ParseInt(lastUsed, 10, 64); err != nil {
+			return token, fmt.Errorf("bad token last use ('%s'): %w", lastUsed, err)
+		}
+	}
+	return token, nil
+}
+
+// decodeApiTokens decodes the stored tokens by name and when they were last used.
+func decodeApiTokens(encoded, lastUsed map[string]string) (map[string]apiToken, error) {
+	tokens := make(map[string]apiToken, len(encoded))
+	for name, value := range encoded {
+		token, err := decodeApiToken(value, lastUsed[name])
+		if err != nil {
+			return nil, fmt.Errorf("token %s: %w", name, err)
+		}
+		tokens[name] = token
+	}
+	return tokens, nil
+}
+
+// parseScopes splits the comma-separated scopes and checks them.
+func parseScopes(scopes string) ([]string, error) {
+	out := []string{}
+	for _, scope := range strings.Split(scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if !slices.Contains(tokenScopeNames, scope) {
+			return nil, fmt.Errorf("scope %s is invalid, needs to be one of %s",
+				scope, strings.Join(tokenScopeNames, ", "))
+		}
+		if !slices.Contains(out, scope) {
+			out = append(out, scope)
+		}
+	}
+	return out, nil
+}
+
+// newTokenSecret returns a new token with the name, as given to the clients:
+// the name and a random secret separated by a dot, and the hash of it to keep.
+func newTokenSecret(name string) (secret, hash string) {
+	random := make([]byte, 32)
+	rand.Read(random) // never fails
+	secret = name + "." + hex.EncodeToString(random)
+	return secret, rei.Sha256([]byte(secret))
+}
+
+// tokenContextKey is the context key of the token of the request.
+type tokenContextKey struct{}
+
+// requestToken is the token the request was made with.
+type requestToken struct {
+	// name is the name of the token, empty if there's no auth.
+	name string
+	// token is the token, with its scopes.
+	token apiToken
+}
+
+// tokenName returns the name of the token the request was made with, empty
+// if there's no auth.
+func tokenName(r *http.Request) string {
+	current, _ := r.Context().Value(tokenContextKey{}).(requestToken)
+	return current.name
+}
+
+// authenticate finds the token of the request, from the Authorization header
+// (as "Bearer token"), and answers 401 Unauthorized if there's no valid one.
+// Without auth (-no-auth), every request is let through without a token.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := requestToken{token: apiToken{Scopes: []string{scopeAdmin}}}
+		if !setting(noAuth) {
+			var code MonokumaStatusCode
+			var err error
+			current, code, err = findToken(r.Header.Get("Authorization"))
+			if err != nil {
+				writeError(w, r, code, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, current)))
+	})
+}
+
+// findToken returns the token of the Authorization header, errUnauthorized if
+// it's not a valid one.
+func findToken(header string) (requestToken, MonokumaStatusCode, error) {
+	secret, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || len(secret) < 1 {
+		return requestToken{}, Unauthorized, errUnauthorized
+	}
+	legacy := setting(auth)
+	if len(legacy) > 0 && subtle.ConstantTimeCompare([]byte(secret), []byte(legacy)) == 1 {
+		return requestToken{name: legacyTokenName, token: apiToken{Scopes: []string{scopeAdmin}}}, Success, nil
+	}
+
+	name, _, _ := strings.Cut(secret, ".")
+	if !tokenNameRegexp.MatchString(name) {
+		return requestToken{}, Unauthorized, errUnauthorized
+	}
+	token, found, err := monomi.getToken(name)
+	if err != nil {
+		code := Uncategorized
+		if degraded.Load() {
+			code = StoreUnavailable
+		}
+		return requestToken{}, code, fmt.Errorf("critical failure during token retrieval: %v", err)
+	}
+	hash := rei.Sha256([]byte(secret))
+	if !found || subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) != 1 {
+		return requestToken{}, Unauthorized, errUnauthorized
+	}
+	touchToken(name)
+	return requestToken{name: name, token: token}, Success, nil
+}
+
+// touchToken saves that the token was used now, if it wasn't saved in the
+// last tokenTouchInterval.
+func touchToken(name string) {
+	now := time.Now().Unix()
+	if last, ok := touchedTokens.Load(name); ok && now-last.(int64) < int64(tokenTouchInterval.Seconds()) {
+		return
+	}
+	touchedTokens.Store(name, now)
+	if err := monomi.touchToken(name, now); err != nil {
+		log.Printf("saving last use of token %s: %v", name, err)
+	}
+}
+
+// requireScope answers 403 Forbidden if the token of the request doesn't
+// have the scope, see authenticate.
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			current, _ := r.Context().Value(tokenContextKey{}).(requestToken)
+			if !current.token.allows(scope) {
+				writeError(w, r, Forbidden, fmt.Errorf("forbidden, the token needs the %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isTokenCommand returns true if the tokens are to be managed instead of
+// serving, see runTokenCommand.
+func isTokenCommand() bool {
+	return len(*tokenCreate) > 0 || len(*tokenRevoke) > 0 || *tokenList
+}
+
+// runTokenCommand creates, revokes, or lists the tokens in the store.
+func runTokenCommand() error {
+	if *storeBackend == storeMemory {
+		return errors.New("the memory store is gone when we exit, tokens need another store")
+	}
+	store := NewLinkStore()
+	defer store.Close()
+
+	switch {
+	case len(*tokenCreate) > 0:
+		name := *tokenCreate
+		if !tokenNameRegexp.MatchString(name) || name == legacyTokenName {
+			return fmt.Errorf("token name %s is invalid, needs to match %s and not be %s",
+				name, tokenNameRegexp, legacyTokenName)
+		}
+		scopes, err := parseScopes(*tokenScopes)
+		if err != nil {
+			return err
+		}
+		limits, err := parseTokenLimits(*tokenCreateLimits)
+		if err != nil {
+			return err
+		}
+		if err := validateLimits(limits.over(serverLimits())); err != nil {
+			return err
+		}
+		secret, hash := newTokenSecret(name)
+		token := apiToken{Hash: hash, Scopes: scopes, Limits: limits, Created: time.Now().Unix()}
+		if err := store.createToken(name, token); err != nil {
+			return fmt.Errorf("creating token %s: %w", name, err)
+		}
+		fmt.Printf("created token %s with scopes %s, keep it safe, it can't be shown again:\n%s\n",
+			name, strings.Join(scopes, ","), secret)
+	case len(*tokenRevoke) > 0:
+		found, err := store.deleteToken(*tokenRevoke)
+		if err != nil {
+			return fmt.Errorf("revoking token %s: %w", *tokenRevoke, err)
+		}
+		if !found {
+			return fmt.Errorf("token %s not found", *tokenRevoke)
+		}
+		fmt.Printf("revoked token %s\n", *tokenRevoke)
+	case *tokenList:
+		tokens, err := store.listTokens()
+		if err != nil {
+			return fmt.Errorf("listing tokens: %w", err)
+		}
+		for _, name := range slices.Sorted(maps.Keys(tokens)) {
+			token := tokens[name]
+			lastUsed := "never"
+			if token.LastUsed != 0 {
+				lastUsed = time.Unix(token.LastUsed, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%s\tscopes=%s\tlimits=%s\tcreated=%s\tlast_used=%s\n", name, strings.Join(token.Scopes, ","),
+				cmp.Or(token.Limits.String(), "server"), time.Unix(token.Created, 0).UTC().Format(time.RFC3339), lastUsed)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// trafficHuman is the traffic of people following the short links.
+	trafficHuman = "human"
+	// trafficBot is the traffic of crawlers, scripts, and uptime checkers.
+	trafficBot = "bot"
+	// trafficPreview is the traffic of link unfurlers, like the ones of chat
+	// apps showing a preview of the link.
+	trafficPreview = "preview"
+	// trafficAll is all of the traffic together, only for reading the stats.
+	trafficAll = "all"
+)
+
+// trafficClasses are all the classes of traffic.
+var trafficClasses = []string{trafficHuman, trafficBot, trafficPreview}
+
+// defaultAgentRules are the user-agent rules used when no rule file is given,
+// in the same format as the rule files, see parseAgentRules.
+const defaultAgentRules = `
+# chat apps and social networks unfurling links.
+preview (?i)slackbot|slack-imgproxy|discordbot|twitterbot|facebookexternalhit|facebot
+preview (?i)whatsapp|telegrambot|linkedinbot|skypeuripreview|mattermost|redditbot
+preview (?i)embedly|iframely|vkshare|pinterest|mastodon|snapchat|bluesky|cardyb
+
+# uptime checkers.
+bot (?i)uptimerobot|pingdom|statuscake|betteruptime|uptime-kuma|site24x7|updown\.io|freshping
+
+# crawlers and scripts.
+bot (?i)bot\b|bot/|crawl|spider|slurp|archiver|headless
+bot (?i)^(curl|wget|python-requests|python-urllib|go-http-client|java|okhttp|axios|node-fetch|libwww-perl|httpie)
+
+# no user-agent at all is never a browser.
+bot ^$
+`
+
+var (
+	// agentRulesPath is the path to the user-agent rule file, empty for
+	// defaultAgentRules.
+	agentRulesPath *string
+
+	// agentRules are the rules that classify the traffic, see classifyTraffic.
+	agentRules []agentRule
+)
+
+// agentRule classifies the user-agents that match it.
+type agentRule struct {
+	// class is the class of traffic of the matching user-agents.
+	class string
+	// pattern matches the user-agents.
+	pattern *regexp.Regexp
+}
+
+// loadAgentRules loads the user-agent rules from the file at path, or the
+// default ones if path is empty.
+func loadAgentRules(path string) ([]agentRule, error) {
+	if len(path) < 1 {
+		return parseAgentRules(strings.NewReader(defaultAgentRules))
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening agent rules: %w", err)
+	}
+	defer file.Close()
+	rules, err := parseAgentRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading agent rules from %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// parseAgentRules parses the user-agent rules. Each line is a class of traffic
+// and a regular expression, separated by a space, like "bot (?i)crawler".
+// Empty lines and lines starting with # are skipped.
+func parseAgentRules(reader io.Reader) ([]agentRule, error) {
+	rules := []agentRule{}
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) < 1 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		class, pattern, _ := strings.Cut(text, " ")
+		if !slices.Contains(trafficClasses, class) {
+			return nil, fmt.Errorf("line %d: class %s is invalid, needs to be one of %s",
+				line, class, strings.Join(trafficClasses, ", "))
+		}
+		// an empty pattern would match every user-agent.
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) < 1 {
+			return nil, fmt.Errorf("line %d: class %s has no pattern", line, class)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad pattern: %w", line, err)
+		}
+		rules = append(rules, agentRule{class: class, pattern: re})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// classifyTraffic returns the class of traffic of the user-agent, the class
+// of the first rule that matches it, or trafficHuman if none does.
+func classifyTraffic(agent string) string {
+	for _, rule := range setting(&agentRules) {
+		if rule.pattern.MatchString(agent) {
+			return rule.class
+		}
+	}
+	return trafficHuman
+}
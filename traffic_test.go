@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAgentRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		classes []string
+		ok      bool
+	}{
+		{"empty", "", []string{}, true},
+		{"comments and blank lines", "# a comment\n\n   \nbot curl\n  # indented\npreview (?i)slack\n", []string{"bot", "preview"}, true},
+		{"pattern with spaces", "human Mozilla/5\\.0 \\(X11", []string{"human"}, true},
+		{"human rules", "human ^Mozilla/\n", []string{"human"}, true},
+		{"bad class", "robot curl\n", nil, false},
+		{"all isn't a class", "all curl\n", nil, false},
+		{"bad pattern", "bot (unclosed\n", nil, false},
+		{"no pattern", "bot\n", nil, false},
+		{"defaults", defaultAgentRules, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := parseAgentRules(strings.NewReader(test.rules))
+			if (err == nil) != test.ok {
+				t.Fatalf("parseAgentRules() error = %v, want ok %v", err, test.ok)
+			}
+			if test.classes == nil {
+				return
+			}
+			if len(rules) != len(test.classes) {
+				t.Fatalf("parseAgentRules() = %d rules, want %d", len(rules), len(test.classes))
+			}
+			for i, rule := range rules {
+				if rule.class != test.classes[i] {
+					t.Errorf("rule %d class = %s, want %s", i, rule.class, test.classes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClassifyTraffic(t *testing.T) {
+	rules, err := loadAgentRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := agentRules
+	agentRules = rules
+	t.Cleanup(func() { agentRules = old })
+
+	tests := map[string]string{
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)":                trafficPreview,
+		"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)": trafficPreview,
+		"Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)":         trafficPreview,
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":  trafficBot,
+		"Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)":    trafficBot,
+		"curl/8.0.1":             trafficBot,
+		"python-requests/2.31.0": trafficBot,
+		"":                       trafficBot,
+		"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0":                                                                  trafficHuman,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1": trafficHuman,
+	}
+	for agent, want := range tests {
+		if got := classifyTraffic(agent); got != want {
+			t.Errorf("classifyTraffic(%q) = %s, want %s", agent, got, want)
+		}
+	}
+}
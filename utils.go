@@ -3,11 +3,8 @@ package main
 import (
 	"crypto/rand"
 	"encoding/binary"
-	"fmt"
 	"os"
 	"regexp"
-
-	"github.com/thecsw/rei"
 )
 
 const (
@@ -19,6 +16,10 @@ var (
 	// URLRegexp is a regular expression to match URLs.
 	URLRegexp = regexp.MustCompile(URLRegexpPattern)
 
+	// alphabetRegexp is a regular expression to match alphabets, they can only
+	// have the characters the keys can.
+	alphabetRegexp = regexp.MustCompile(`^[-0-9a-zA-Z]+$`)
+
 	// keysize is used to generate random string.
 	keysize *int
 
@@ -29,22 +30,15 @@ var (
 // gen generates random string of given length (keysize) from alphabet.
 func gen() string {
 	b := make([]byte, 2)
-	res := make([]rune, *keysize)
+	letters := setting(alphabet)
+	res := make([]rune, setting(keysize))
 	for i := range res {
 		rand.Read(b) // will read 2bytes=16bits=2^16=65535val
-		res[i] = rune((*alphabet)[uint16(binary.BigEndian.Uint16(b)%uint16(len(*alphabet)))])
+		res[i] = rune(letters[uint16(binary.BigEndian.Uint16(b)%uint16(len(letters)))])
 	}
 	return string(res)
 }
 
-// pathMustExist checks if file exists, exits if not.
-func pathMustExist(path, description string) {
-	if !rei.FileMustExist(path) {
-		fmt.Printf("%s '%s' does not exist\n", description, path)
-		os.Exit(1)
-	}
-}
-
 // getEnv gets environment variable or exits if it's not set.
 func getEnv(envname string) *string {
 	if val, ok := os.LookupEnv(envname); ok {